@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5" //nolint:gosec
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// ServerInfo records information about an SMTP server, for use by
+// SASL mechanisms
+type ServerInfo struct {
+	Name     string               // SMTP server name
+	TLS      bool                 // using TLS
+	TLSState *tls.ConnectionState // the TLS session, for channel binding
+	Auth     []string             // advertised authentication mechanisms
+}
+
+// offers reports whether the server advertised a mechanism
+func (s *ServerInfo) offers(mech string) bool {
+	for _, m := range s.Auth {
+		if strings.EqualFold(m, mech) {
+			return true
+		}
+	}
+	return false
+}
+
+// Auth is implemented by a SASL mechanism. It follows net/smtp.Auth,
+// but each step also returns a printable version of the response,
+// with any secrets redacted, for the transcript.
+type Auth interface {
+	// Start begins an authentication with a server.
+	// It returns the name of the authentication protocol
+	// and optionally data to include in the initial AUTH message
+	// sent to the server.
+	Start(server *ServerInfo) (proto string, toServer []byte, display string, err error)
+
+	// Next continues the authentication. The server has just sent
+	// the fromServer data. If more is true, the server expects a
+	// response, which Next should return as toServer; otherwise
+	// Next should return toServer == nil.
+	Next(fromServer []byte, more bool) (toServer []byte, display string, err error)
+}
+
+const redacted = "********"
+
+type authMechanism struct {
+	name  string
+	token bool // uses an OAuth token rather than a password
+	make  func(config Config) Auth
+}
+
+// authMechanisms are the mechanisms we support, in the order we
+// prefer them when the user doesn't choose
+var authMechanisms = []authMechanism{
+	{"OAUTHBEARER", true, func(config Config) Auth {
+		return &oauthAuth{config: config, mech: "OAUTHBEARER", username: config.AuthUser, token: config.authToken}
+	}},
+	{"XOAUTH2", true, func(config Config) Auth {
+		return &oauthAuth{config: config, mech: "XOAUTH2", username: config.AuthUser, token: config.authToken}
+	}},
+	{"SCRAM-SHA-256-PLUS", false, func(config Config) Auth { return newSCRAM(config, "SCRAM-SHA-256-PLUS") }},
+	{"SCRAM-SHA-256", false, func(config Config) Auth { return newSCRAM(config, "SCRAM-SHA-256") }},
+	{"SCRAM-SHA-1-PLUS", false, func(config Config) Auth { return newSCRAM(config, "SCRAM-SHA-1-PLUS") }},
+	{"SCRAM-SHA-1", false, func(config Config) Auth { return newSCRAM(config, "SCRAM-SHA-1") }},
+	{"CRAM-MD5", false, func(config Config) Auth { return &cramMD5Auth{config.AuthUser, config.AuthPassword} }},
+	{"PLAIN", false, func(config Config) Auth { return &plainAuth{"", config.AuthUser, config.AuthPassword} }},
+	{"LOGIN", false, func(config Config) Auth { return &loginAuth{username: config.AuthUser, password: config.AuthPassword} }},
+}
+
+// chooseAuth picks a mechanism the server offers, from those the user
+// asked for, or from all we support
+func (c *Client) chooseAuth() (authMechanism, error) {
+	offered := map[string]bool{}
+	for _, mech := range c.auth {
+		offered[strings.ToUpper(mech)] = true
+	}
+	wanted := c.config.authMechs
+	if len(wanted) == 0 {
+		for _, m := range authMechanisms {
+			if strings.HasSuffix(m.name, "-PLUS") && !c.tls {
+				// Channel binding needs TLS
+				continue
+			}
+			if m.token != c.config.haveAuthToken() {
+				// Use a token if we have one, a password if not
+				continue
+			}
+			wanted = append(wanted, m.name)
+		}
+	}
+	for _, name := range wanted {
+		if !offered[name] {
+			continue
+		}
+		for _, m := range authMechanisms {
+			if m.name == name {
+				return m, nil
+			}
+		}
+	}
+	return authMechanism{}, fmt.Errorf("server doesn't offer any of %s", strings.Join(wanted, ", "))
+}
+
+// maybeAuth authenticates, if we've been asked to
+func (c *Client) maybeAuth() error {
+	if c.config.Auth == "" {
+		return nil
+	}
+	if len(c.auth) == 0 {
+		c.Message(HintError, "Server doesn't advertise AUTH")
+		return BailedError("AUTH not offered")
+	}
+	m, err := c.chooseAuth()
+	if err != nil {
+		c.Messagef(HintError, "No usable AUTH mechanism: %v (server offers %s)", err, strings.Join(c.auth, " "))
+		return BailedError("no usable AUTH mechanism")
+	}
+	if m.token {
+		// Only now, so a token command isn't run for nothing
+		if err = c.config.loadAuthToken(); err != nil {
+			c.Messagef(HintError, "Can't get an OAuth token: %v", err)
+			return BailedError("no OAuth token")
+		}
+	}
+	return c.Auth(m.make(c.config))
+}
+
+// Auth authenticates a client using the provided authentication mechanism.
+// A failed authentication closes the connection.
+// Only servers that advertise the AUTH extension support this function.
+func (c *Client) Auth(a Auth) error {
+	if err := c.hello(); err != nil {
+		return err
+	}
+	encoding := base64.StdEncoding
+	info := &ServerInfo{Name: c.remoteHost, TLS: c.tls, Auth: c.auth}
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		info.TLSState = &state
+	}
+	mech, resp, display, err := a.Start(info)
+	if err != nil {
+		c.Messagef(HintError, "AUTH %s: %v", mech, err)
+		return err
+	}
+	if !c.tls {
+		c.Messagef(HintWarn, "Authenticating with %s without TLS", mech)
+	}
+	line := "AUTH " + mech
+	if resp != nil {
+		// An empty initial response is sent as "=", RFC 4954 section 4
+		r64 := "="
+		if len(resp) > 0 {
+			r64 = encoding.EncodeToString(resp)
+		}
+		line += " " + r64
+	}
+	code, msg64, err := c.authCmd(StageAuth, line, resp, display)
+	for err == nil {
+		var msg []byte
+		switch code {
+		case 334:
+			msg, err = encoding.DecodeString(msg64)
+			if err == nil {
+				c.Messagef(HintInfo, "  decoded challenge: %q", msg)
+			}
+		case 235:
+			// the last message isn't base64 because it isn't a challenge
+			msg = []byte(msg64)
+		default:
+			err = &textproto.Error{Code: code, Msg: msg64}
+		}
+		if err != nil {
+			break
+		}
+		resp, display, err = a.Next(msg, code == 334)
+		if err != nil {
+			c.Messagef(HintError, "AUTH %s: %v", mech, err)
+			if code == 334 {
+				// abort the AUTH
+				_, _, _ = c.authCmd(StageNone, "*", nil, "")
+			}
+			break
+		}
+		if resp == nil {
+			break
+		}
+		code, msg64, err = c.authCmd(StageNone, encoding.EncodeToString(resp), resp, display)
+	}
+	var exitErr ExitError
+	if errors.As(err, &exitErr) {
+		// We dropped the connection as asked
+		return err
+	}
+	if err != nil {
+		c.Messagef(HintError, "Authentication with %s failed", mech)
+		return err
+	}
+	c.Messagef(HintInfo, "Authenticated with %s", mech)
+	return c.stopAfter(StageAuth)
+}
+
+// authCmd sends one line of an AUTH exchange, at stage as for rawCmd.
+// It shows the decoded response and, if that had to be redacted, hides
+// the line itself.
+func (c *Client) authCmd(stage Stage, line string, resp []byte, display string) (int, string, error) {
+	shown := line
+	if resp != nil && display != string(resp) {
+		shown = strings.Replace(line, base64.StdEncoding.EncodeToString(resp), redacted, 1)
+	}
+	c.Message(HintSend, shown)
+	if resp != nil {
+		c.Messagef(HintInfo, "  decoded response: %q", display)
+	}
+
+	_ = c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	defer func() {
+		_ = c.conn.SetDeadline(time.Time{})
+	}()
+	id, err := c.Text.Cmd("%s", line)
+	if err != nil {
+		return 0, "", err
+	}
+	if err = c.dropAfterSend(stage); err != nil {
+		return 0, "", err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	return c.ReadResponse(0)
+}
+
+// plainAuth is RFC 4616 PLAIN
+type plainAuth struct {
+	identity, username, password string
+}
+
+func (a *plainAuth) Start(server *ServerInfo) (string, []byte, string, error) {
+	resp := []byte(a.identity + "\x00" + a.username + "\x00" + a.password)
+	return "PLAIN", resp, a.identity + "\x00" + a.username + "\x00" + redacted, nil
+}
+
+func (a *plainAuth) Next(fromServer []byte, more bool) ([]byte, string, error) {
+	if more {
+		return nil, "", errors.New("unexpected server challenge")
+	}
+	return nil, "", nil
+}
+
+// loginAuth is the obsolete but widely used LOGIN mechanism, which
+// sends the username and password in response to two challenges
+type loginAuth struct {
+	username, password string
+	step               int
+}
+
+func (a *loginAuth) Start(server *ServerInfo) (string, []byte, string, error) {
+	return "LOGIN", nil, "", nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, string, error) {
+	if !more {
+		return nil, "", nil
+	}
+	a.step++
+	switch a.step {
+	case 1:
+		return []byte(a.username), a.username, nil
+	case 2:
+		return []byte(a.password), redacted, nil
+	}
+	return nil, "", errors.New("unexpected server challenge")
+}
+
+// cramMD5Auth is RFC 2195 CRAM-MD5
+type cramMD5Auth struct {
+	username, secret string
+}
+
+func (a *cramMD5Auth) Start(server *ServerInfo) (string, []byte, string, error) {
+	return "CRAM-MD5", nil, "", nil
+}
+
+func (a *cramMD5Auth) Next(fromServer []byte, more bool) ([]byte, string, error) {
+	if !more {
+		return nil, "", nil
+	}
+	d := hmac.New(md5.New, []byte(a.secret))
+	d.Write(fromServer)
+	resp := a.username + " " + hex.EncodeToString(d.Sum(nil))
+	return []byte(resp), resp, nil
+}
+
+// normalizeAuth turns on authentication if we've been given
+// credentials, and checks the mechanisms we've been asked for
+func (config *Config) normalizeAuth() error {
+	if err := config.checkAuthToken(); err != nil {
+		return err
+	}
+	if config.Auth == "" && (config.AuthUser != "" || config.AuthPassword != "" || config.haveAuthToken()) {
+		config.Auth = "ANY"
+	}
+	if config.Auth == "" || strings.EqualFold(config.Auth, "ANY") {
+		return nil
+	}
+	for _, mech := range strings.Split(config.Auth, ",") {
+		mech = strings.ToUpper(strings.TrimSpace(mech))
+		known := false
+		for _, m := range authMechanisms {
+			if m.name == mech {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return Fatalf(ExitFlags, "invalid value for --auth: unsupported mechanism '%s'", mech)
+		}
+		config.authMechs = append(config.authMechs, mech)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// testAuth makes the mechanism called mech from config
+func testAuth(t *testing.T, config Config, mech string) Auth {
+	t.Helper()
+	for _, m := range authMechanisms {
+		if m.name == mech {
+			if m.token {
+				if err := config.loadAuthToken(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return m.make(config)
+		}
+	}
+	t.Fatalf("no mechanism %s", mech)
+	return nil
+}
+
+// TestSASL runs each mechanism through an exchange with the given
+// challenges and checks what's sent, and what's shown in its place
+func TestSASL(t *testing.T) {
+	type step struct {
+		challenge string
+		resp      string
+		display   string
+	}
+	tests := []struct {
+		mech    string
+		initial *step
+		steps   []step
+	}{
+		{
+			mech:    "PLAIN",
+			initial: &step{resp: "\x00tim\x00tanstaaftanstaaf", display: "\x00tim\x00" + redacted},
+		},
+		{
+			mech: "LOGIN",
+			steps: []step{
+				{"Username:", "tim", "tim"},
+				{"Password:", "tanstaaftanstaaf", redacted},
+			},
+		},
+		{
+			// RFC 2195 section 2
+			mech: "CRAM-MD5",
+			steps: []step{
+				{"<1896.697170952@postoffice.reston.mci.net>", "tim b913a602c7eda7a495b4e6e7334d3890", "tim b913a602c7eda7a495b4e6e7334d3890"},
+			},
+		},
+		{
+			mech: "XOAUTH2",
+			initial: &step{
+				resp:    "user=tim\x01auth=Bearer vF9dft4qmT\x01\x01",
+				display: "user=tim\x01auth=Bearer " + redacted + "\x01\x01",
+			},
+			steps: []step{{`{"status":"401"}`, "", ""}},
+		},
+		{
+			mech: "OAUTHBEARER",
+			initial: &step{
+				resp:    "n,a=tim,\x01host=mail.example.com\x01auth=Bearer vF9dft4qmT\x01\x01",
+				display: "n,a=tim,\x01host=mail.example.com\x01auth=Bearer " + redacted + "\x01\x01",
+			},
+			steps: []step{{`{"status":"invalid_token"}`, "\x01", "\x01"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mech, func(t *testing.T) {
+			config := testConfig(t, "--auth-user", "tim", "--auth-password", "tanstaaftanstaaf", "--auth-token", "vF9dft4qmT")
+			a := testAuth(t, config, tt.mech)
+			mech, resp, display, err := a.Start(&ServerInfo{Name: "mail.example.com", Auth: []string{tt.mech}})
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			if mech != tt.mech {
+				t.Errorf("Start() mechanism = %q, want %q", mech, tt.mech)
+			}
+			if tt.initial == nil {
+				if resp != nil {
+					t.Errorf("Start() = %q, want no initial response", resp)
+				}
+			} else if string(resp) != tt.initial.resp || display != tt.initial.display {
+				t.Errorf("Start() = %q shown as %q, want %q shown as %q", resp, display, tt.initial.resp, tt.initial.display)
+			}
+			for _, s := range tt.steps {
+				testOutput(t, func() {
+					resp, display, err = a.Next([]byte(s.challenge), true)
+				})
+				if err != nil {
+					t.Fatalf("Next(%q): %v", s.challenge, err)
+				}
+				if resp == nil || string(resp) != s.resp || display != s.display {
+					t.Errorf("Next(%q) = %q shown as %q, want %q shown as %q", s.challenge, resp, display, s.resp, s.display)
+				}
+			}
+			if resp, _, err = a.Next(nil, false); resp != nil || err != nil {
+				t.Errorf("Next() after success = %q, %v", resp, err)
+			}
+		})
+	}
+}
+
+func TestSASLUnexpectedChallenge(t *testing.T) {
+	for _, mech := range []string{"PLAIN", "LOGIN", "XOAUTH2"} {
+		t.Run(mech, func(t *testing.T) {
+			a := testAuth(t, testConfig(t, "--auth-user", "tim", "--auth-password", "x", "--auth-token", "y"), mech)
+			if _, _, _, err := a.Start(&ServerInfo{Name: "mail.example.com"}); err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			var err error
+			testOutput(t, func() {
+				for i := 0; i < 3 && err == nil; i++ {
+					_, _, err = a.Next([]byte("again?"), true)
+				}
+			})
+			if err == nil {
+				t.Error("Next() answered every challenge")
+			}
+		})
+	}
+}
+
+// TestAuthTranscript authenticates with a test server and checks the
+// password goes over the wire but isn't shown, encoded or not
+func TestAuthTranscript(t *testing.T) {
+	b64 := base64.StdEncoding.EncodeToString
+	tests := []struct {
+		mech      string
+		challenge []string
+		want      []string
+	}{
+		{"PLAIN", nil, []string{"AUTH PLAIN " + b64([]byte("\x00tim\x00tanstaaftanstaaf"))}},
+		{"LOGIN", []string{"334 VXNlcm5hbWU6", "334 UGFzc3dvcmQ6"}, []string{"AUTH LOGIN", b64([]byte("tim")), b64([]byte("tanstaaftanstaaf"))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mech, func(t *testing.T) {
+			step := 0
+			addr, wait := testSMTPServer(t, []string{"AUTH PLAIN LOGIN"}, func(cmd string) string {
+				if !strings.HasPrefix(cmd, "AUTH") && step == 0 {
+					return ""
+				}
+				step++
+				if step <= len(tt.challenge) {
+					return tt.challenge[step-1]
+				}
+				step = 0
+				return "235 2.7.0 ok"
+			})
+			config := testConfig(t, "--server", addr, "--timeout", "5s", "--auth="+tt.mech,
+				"--auth-user", "tim", "--auth-password", "tanstaaftanstaaf", "--quit-after", "auth")
+			config.HideSend, config.HideInfo = false, false
+			payload, err := MakePayload(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := testOutput(t, func() {
+				err = send(config, payload)
+			})
+			received := wait()
+			if exitCode(err) != ExitOk {
+				t.Fatalf("send: %v", err)
+			}
+
+			var sent []string
+			for _, line := range received {
+				if strings.HasPrefix(line, "AUTH") || len(sent) > 0 && line != "QUIT" {
+					sent = append(sent, line)
+				}
+			}
+			if strings.Join(sent, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("sent %q, want %q", sent, tt.want)
+			}
+			for _, secret := range append([]string{"tanstaaftanstaaf"}, tt.want[len(tt.want)-1]) {
+				if strings.Contains(out, secret) {
+					t.Errorf("%q shown:\n%s", secret, out)
+				}
+			}
+			if !strings.Contains(out, redacted) {
+				t.Errorf("redacted password not shown:\n%s", out)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// useBDAT reports whether to send the message with BDAT, as
+// described in RFC 3030
+func (c *Client) useBDAT() bool {
+	if !c.config.BDAT {
+		return false
+	}
+	if _, ok := c.ext["CHUNKING"]; !ok {
+		c.Message(HintWarn, "Server doesn't advertise CHUNKING, using DATA")
+		return false
+	}
+	return true
+}
+
+// is7bit reports whether s can be sent without any MIME body extension
+func is7bit(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] == 0 || s[i] > 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// isBinary reports whether s needs BINARYMIME rather than 8BITMIME,
+// because it has NULs, a CR or LF that isn't part of a CRLF, or a line
+// longer than the 998 octets RFC 5321 section 4.5.3.1.6 allows
+func isBinary(s string) bool {
+	lineLen := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == 0:
+			return true
+		case s[i] == '\r':
+			if i+1 == len(s) || s[i+1] != '\n' {
+				return true
+			}
+			i++
+			lineLen = 0
+			continue
+		case s[i] == '\n':
+			return true
+		}
+		lineLen++
+		if lineLen > 998 {
+			return true
+		}
+	}
+	return false
+}
+
+// sendBDAT sends the message as one or more BDAT chunks. Unlike DATA
+// there's no dot stuffing, the message is sent exactly as it is.
+func (c *Client) sendBDAT(payload string) error {
+	if c.binary {
+		if _, ok := c.ext["BINARYMIME"]; !ok {
+			c.Message(HintWarn, "Message needs BINARYMIME, but server doesn't advertise it")
+		}
+	}
+	size := c.config.BDATChunkSize
+	first := true
+	for {
+		chunk := payload
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		payload = payload[len(chunk):]
+		last := len(payload) == 0
+		if err := c.bdatChunk(chunk, first, last); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		first = false
+	}
+}
+
+func (c *Client) bdatChunk(chunk string, first, last bool) error {
+	_ = c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	defer func() {
+		_ = c.conn.SetDeadline(time.Time{})
+	}()
+
+	cmd := "BDAT " + strconv.Itoa(len(chunk))
+	if last {
+		cmd += " LAST"
+	}
+	c.Message(HintSendChunk, cmd)
+	if !c.config.SuppressData {
+		for _, line := range strings.SplitAfter(chunk, "\n") {
+			if line != "" {
+				c.Message(HintSend, strings.TrimSuffix(line, "\r\n"))
+			}
+		}
+	}
+
+	id := c.Text.Next()
+	c.Text.StartRequest(id)
+	_, err := c.Text.W.WriteString(cmd + "\r\n" + chunk)
+	if err == nil {
+		err = c.Text.W.Flush()
+	}
+	c.Text.EndRequest(id)
+	if err != nil {
+		return err
+	}
+	if first {
+		if err = c.dropAfterSend(StageData); err != nil {
+			return err
+		}
+	}
+	if last {
+		if err = c.dropAfterSend(StageDot); err != nil {
+			return err
+		}
+	}
+
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	c.recvHint = HintRecvChunk
+	defer func() {
+		c.recvHint = HintRecv
+	}()
+	if last && c.lmtp() {
+		return c.lmtpResponses()
+	}
+	_, _, err = c.ReadResponse(250)
+	if err != nil || !first {
+		return err
+	}
+	return c.stopAfter(StageData)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsBinary(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want bool
+	}{
+		{"7 bit", "Subject: hi\r\n\r\nhello\r\n", false},
+		{"8 bit text", "Subject: caf\xc3\xa9\r\n\r\nna\xc3\xafve\r\n", false},
+		{"empty", "", false},
+		{"NUL", "Subject: hi\r\n\r\nhel\x00lo\r\n", true},
+		{"bare LF", "Subject: hi\n\nhello\n", true},
+		{"bare CR", "Subject: hi\r\n\r\nhel\rlo\r\n", true},
+		{"CR at end", "hello\r", true},
+		{"998 octet line", strings.Repeat("x", 998) + "\r\n", false},
+		{"999 octet line", "short\r\n" + strings.Repeat("x", 999) + "\r\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isBinary(tt.s); got != tt.want {
+				t.Errorf("isBinary() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBodyParam(t *testing.T) {
+	ext := []string{"8BITMIME", "BINARYMIME", "CHUNKING"}
+	tests := []struct {
+		name    string
+		payload string
+		bdat    bool
+		want    string
+	}{
+		{"8 bit with BDAT", "caf\xc3\xa9\r\n", true, "MAIL FROM:<sender@example.com> BODY=8BITMIME"},
+		{"binary with BDAT", "a\x00b\r\n", true, "MAIL FROM:<sender@example.com> BODY=BINARYMIME"},
+		{"binary with DATA", "a\x00b\r\n", false, "MAIL FROM:<sender@example.com> BODY=8BITMIME"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testClient(t, ext)
+			c.bdat = tt.bdat
+			c.binary = isBinary(tt.payload)
+			got, err := c.mailCommand("sender@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("mailCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/textproto"
@@ -13,22 +14,35 @@ import (
 )
 
 type Client struct {
-	config     Config
-	Text       *textproto.Conn
-	remoteHost string
-	conn       net.Conn
-	tls        bool
-	didHello   bool
-	helloError error
-	ext        map[string]string // supported extensions
-	auth       []string          // authentication types
-	rcpts      []string          // recipients accepted in this session
+	config      Config
+	Text        *textproto.Conn
+	remoteHost  string
+	conn        net.Conn
+	tls         bool
+	didHello    bool
+	helloError  error
+	helloCount  int               // number of EHLOs sent this session
+	ext         map[string]string // supported extensions
+	auth        []string          // authentication types
+	rcpts       []string          // recipients accepted in this session
+	recvHint    Hint              // how to display what we receive
+	bdat        bool              // send the message with BDAT rather than DATA
+	binary      bool              // the message needs BINARYMIME
+	xclient     bool              // XCLIENT has been sent
+	rcptResults []RcptResult      // responses to RCPT this session
+	banner      string            // the greeting the server sent
+	latencies   []Latency         // how long each step of the session took
+
+	paramWarnings map[string]struct{} // --mail-param and --rcpt-param warnings given
 }
 
 func Dial(config Config, addr string, v4only bool) (net.Conn, error) {
 	config.Messagef(HintInfo, "Trying %s...", addr)
 	var network string
 	switch {
+	case isUnixSocket(addr):
+		network = "unix"
+		addr = strings.TrimPrefix(addr, "unix:")
 	case config.V4, v4only:
 		network = "tcp4"
 	case config.V6:
@@ -36,12 +50,34 @@ func Dial(config Config, addr string, v4only bool) (net.Conn, error) {
 	default:
 		network = "tcp"
 	}
-	conn, err := net.DialTimeout(network, addr, config.Timeout)
+	local, err := config.localAddr(network, addr)
+	if err != nil {
+		config.Messagef(HintWarn, "Failed to connect to %s: %v", addr, err)
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: config.Timeout}
+	if local != nil {
+		// Avoid a typed nil in the interface
+		dialer.LocalAddr = local
+	}
+	var conn net.Conn
+	if config.proxyURL != nil {
+		conn, err = dialProxy(config, dialer, network, addr)
+	} else {
+		conn, err = dialer.Dial(network, addr)
+	}
 
 	if err != nil {
 		config.Messagef(HintWarn, "Failed to connect to %s: %v", addr, err)
+		return nil, err
+	}
+	if config.proxyProtocol != 0 {
+		if err = config.sendProxyHeader(conn); err != nil {
+			_ = conn.Close()
+			return nil, ProxyHeaderError{err: err}
+		}
 	}
-	return conn, err
+	return conn, nil
 	//if err != nil {
 	//	return &Client{config: config}, err
 	//}
@@ -52,10 +88,25 @@ func Dial(config Config, addr string, v4only bool) (net.Conn, error) {
 }
 
 func NewClient(config Config, conn net.Conn, host string) (*Client, error) {
-	config.Messagef(HintInfo, "Connected to %s.", host)
+	if conn.LocalAddr().Network() == "unix" {
+		config.Messagef(HintInfo, "Connected to %s.", conn.RemoteAddr())
+	} else {
+		config.Messagef(HintInfo, "Connected to %s from %s.", conn.RemoteAddr(), conn.LocalAddr())
+	}
 	c := &Client{
 		config:     config,
 		remoteHost: host,
+		recvHint:   HintRecv,
+	}
+	if config.TLSOnConnect {
+		start := time.Now()
+		tlsConn, err := dialTLS(config, conn, host)
+		if err != nil {
+			_ = conn.Close()
+			return nil, failed(ExitTLS, err)
+		}
+		c.latency("TLS handshake", start)
+		conn = tlsConn
 	}
 	c.setConn(conn)
 	_ = c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
@@ -63,10 +114,13 @@ func NewClient(config Config, conn net.Conn, host string) (*Client, error) {
 		_ = conn.SetDeadline(t)
 	}(c.conn, time.Time{})
 
-	_, _, err := c.ReadResponse(220)
+	start := time.Now()
+	_, msg, err := c.ReadResponse(220)
 	if err != nil {
-		return c, err
+		return c, failed(ExitBanner, err)
 	}
+	c.latency("banner", start)
+	c.banner = msg
 
 	if err = c.stopAfter(StageConnect); err != nil {
 		return c, err
@@ -85,10 +139,7 @@ func (c *Client) Close() error {
 
 func (c *Client) ReadResponse(expectCode int) (int, string, error) {
 	code, message, err := c.Text.ReadResponse(expectCode)
-	// c.Messagef(HintRecv, "%s\n", message)
-	//if err != nil {
-	//	c.Messagef(HintError, err.Error())
-	//}
+	c.explainResponse(code, message)
 	return code, message, err
 }
 
@@ -122,7 +173,7 @@ func (w *recvWriter) Write(b []byte) (int, error) {
 		if bytes.HasSuffix(line, []byte("\n")) {
 			s := w.buff + string(line[:len(line)-1])
 			w.buff = ""
-			w.c.Message(HintRecv, strings.TrimSuffix(s, "\r"))
+			w.c.Message(w.c.recvHint, strings.TrimSuffix(s, "\r"))
 		} else {
 			w.buff += string(line)
 		}
@@ -138,8 +189,10 @@ func (c *Client) hello() error {
 	c.didHello = true
 	if !c.config.SendHelo {
 		err := c.ehlo()
-		if err == nil {
-			return nil
+		var tpErr *textproto.Error
+		if !errors.As(err, &tpErr) || c.lmtp() {
+			// LMTP has no HELO to fall back to
+			return err
 		}
 	}
 	c.helloError = c.helo()
@@ -148,6 +201,19 @@ func (c *Client) hello() error {
 
 // helper to send a command
 func (c *Client) cmd(expectCode int, stage Stage, format string, args ...interface{}) (int, string, error) {
+	code, msg, err := c.rawCmd(expectCode, stage, format, args...)
+	if err != nil || stage == StageNone {
+		return code, msg, err
+	}
+	if saErr := c.stopAfter(stage); saErr != nil {
+		return 0, "", saErr
+	}
+	return code, msg, nil
+}
+
+// rawCmd sends a command and reads the response, but leaves it to
+// the caller to decide whether to stop after it
+func (c *Client) rawCmd(expectCode int, stage Stage, format string, args ...interface{}) (int, string, error) {
 	c.Messagef(HintSend, format, args...)
 
 	c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
@@ -162,43 +228,45 @@ func (c *Client) cmd(expectCode int, stage Stage, format string, args ...interfa
 	}
 
 	c.Text.StartResponse(id)
-	code, msg, err := c.ReadResponse(expectCode)
-	c.Text.EndResponse(id)
-	if err != nil || stage == StageNone {
-		return code, msg, err
-	}
-	if saErr := c.stopAfter(stage); saErr != nil {
-		return 0, "", saErr
-	}
-	return code, msg, nil
+	defer c.Text.EndResponse(id)
+	return c.ReadResponse(expectCode)
 }
 
 // helo sends the HELO greeting to the server. It should be used only when the
 // server does not support ehlo.
 func (c *Client) helo() error {
 	c.ext = nil
+	start := time.Now()
 	_, _, err := c.cmd(250, StageNone, "HELO %s", c.config.Helo)
+	if err == nil {
+		c.latency("HELO", start)
+	}
 	return err
 }
 
 // ehlo sends the EHLO (extended hello) greeting to the server. It
 // should be the preferred greeting for servers that support it.
 func (c *Client) ehlo() error {
-	var stage Stage
-	if c.config.UseStartTLS {
-		if c.tls {
-			stage = StageHelo
-		} else {
-			stage = StageFirstHelo
-		}
-	} else {
-		stage = StageHelo // FIXME(steve): need to handle helo vs first-helo for the non-starttls case
+	// If we're going to STARTTLS or XCLIENT this isn't the final
+	// EHLO. If we're not, stopAfter treats it as both first and final.
+	stage := StageHelo
+	if (c.config.UseStartTLS && !c.tls) || c.pendingXclient() {
+		stage = StageFirstHelo
 	}
+	c.helloCount++
 	cmd := "EHLO"
-	_, msg, err := c.cmd(250, stage, "%s %s", cmd, c.config.Helo)
+	if c.lmtp() {
+		cmd = "LHLO"
+	}
+	start := time.Now()
+	_, msg, err := c.rawCmd(250, stage, "%s %s", cmd, c.config.Helo)
 	if err != nil {
 		return err
 	}
+	c.latency(cmd, start)
+	if err = c.stopAfter(stage); err != nil {
+		return err
+	}
 	ext := make(map[string]string)
 	extList := strings.Split(msg, "\n")
 	if len(extList) > 1 {
@@ -212,6 +280,7 @@ func (c *Client) ehlo() error {
 			}
 		}
 	}
+	c.auth = nil
 	if mechs, ok := ext["AUTH"]; ok {
 		c.auth = strings.Split(mechs, " ")
 	}
@@ -229,10 +298,12 @@ func (c *Client) StartTLS(config *tls.Config) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
-	_, _, err := c.cmd(220, StageStarttls, "STARTTLS")
+	start := time.Now()
+	_, _, err := c.rawCmd(220, StageStarttls, "STARTTLS")
 	if err != nil {
 		return err
 	}
+	c.latency("STARTTLS", start)
 	if config == nil {
 		config = &tls.Config{}
 	}
@@ -241,8 +312,17 @@ func (c *Client) StartTLS(config *tls.Config) error {
 		config = config.Clone()
 		config.ServerName = c.remoteHost
 	}
-	c.setConn(tls.Client(c.conn, config))
-	return c.ehlo()
+	start = time.Now()
+	tlsConn, err := handshake(c.config, c.conn, config, c.remoteHost)
+	if err != nil {
+		return err
+	}
+	c.latency("TLS handshake", start)
+	c.setConn(tlsConn)
+	if err = c.stopAfter(StageStarttls); err != nil {
+		return err
+	}
+	return failed(ExitHeloTLS, c.ehlo())
 }
 
 // Mail issues a MAIL command to the server using the provided email address.
@@ -258,31 +338,67 @@ func (c *Client) Mail(from string) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
-	cmdStr := "MAIL FROM:<%s>"
-	if _, ok := c.ext["8BITMIME"]; ok {
-		cmdStr += " BODY=8BITMIME"
+	cmdStr, err := c.mailCommand(from)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.cmd(250, StageMail, "%s", cmdStr)
+	return err
+}
+
+// mailCommand builds the MAIL command, with any ESMTP parameters
+func (c *Client) mailCommand(from string) (string, error) {
+	cmdStr := "MAIL FROM:<" + from + ">"
+	var params string
+	_, binaryMIME := c.ext["BINARYMIME"]
+	if c.bdat && c.binary && binaryMIME {
+		params += " BODY=BINARYMIME"
+	} else if _, ok := c.ext["8BITMIME"]; ok {
+		params += " BODY=8BITMIME"
 	}
 	if _, ok := c.ext["SIZE"]; ok && c.config.Size != 0 {
-		cmdStr += " SIZE=" + strconv.Itoa(c.config.Size)
-	}
-	// TODO(steve): read rfc8689
-	//if opts != nil && opts.RequireTLS {
-	//	if _, ok := c.ext["REQUIRETLS"]; ok {
-	//		cmdStr += " REQUIRETLS"
-	//	} else {
-	//		return errors.New("smtp: server does not support REQUIRETLS")
-	//	}
-	//}
+		params += " SIZE=" + strconv.Itoa(c.config.Size)
+	}
+	dsn, err := c.dsnMailParams()
+	if err != nil {
+		return "", err
+	}
+	params += dsn
+	if c.config.RequireTLS {
+		// RFC 8689 section 4.2
+		_, ok := c.ext["REQUIRETLS"]
+		switch {
+		case !c.tls:
+			c.Message(HintError, "REQUIRETLS needs a TLS session, but this one isn't encrypted")
+			return "", errors.New("smtp: can't use REQUIRETLS without TLS")
+		case !ok:
+			c.Message(HintError, "server does not support REQUIRETLS, so can't promise to use TLS for onward delivery")
+			return "", errors.New("smtp: server does not support REQUIRETLS")
+		}
+		if !c.config.TLSVerify && !c.config.dane.usable() {
+			// MTA-STS testing mode turns verification off
+			if !c.config.ForceRequireTLS {
+				c.Message(HintError, "REQUIRETLS needs a verified certificate, but certificate verification is turned off")
+				return "", errors.New("smtp: can't use REQUIRETLS without a verified certificate")
+			}
+			c.Message(HintWarn, "REQUIRETLS needs a verified certificate, but certificate verification is turned off")
+		}
+		params += " REQUIRETLS"
+	}
 
 	if c.config.SmtpUTF8 {
 		if _, ok := c.ext["SMTPUTF8"]; ok {
-			cmdStr += " SMTPUTF8"
+			params += " SMTPUTF8"
 		} else {
 			c.Message(HintError, "server does not support SMTPUTF8")
-			return errors.New("smtp: server does not support SMTPUTF8")
+			return "", errors.New("smtp: server does not support SMTPUTF8")
 		}
 	}
 
+	// A parameter given with --mail-param replaces our own
+	cmdStr += withoutParams(params, c.config.mailParams)
+	cmdStr += c.extraParams("MAIL", c.config.mailParams)
+
 	// TODO(steve): consider auth
 	//if opts != nil && opts.Auth != nil {
 	//	if _, ok := c.ext["AUTH"]; ok {
@@ -290,8 +406,7 @@ func (c *Client) Mail(from string) error {
 	//	}
 	//	// We can safely discard parameter if server does not support AUTH.
 	//}
-	_, _, err := c.cmd(250, StageMail, cmdStr, from)
-	return err
+	return cmdStr, nil
 }
 
 // Rcpt issues a RCPT command to the server using the provided email address.
@@ -300,11 +415,33 @@ func (c *Client) Mail(from string) error {
 //
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) Rcpt(to string) error {
-	if _, _, err := c.cmd(25, StageRcpt, "RCPT TO:<%s>", to); err != nil {
+	code, msg, err := c.rawCmd(25, StageRcpt, "%s", c.rcptCommand(to))
+	c.recordRcpt(to, code, msg)
+	if err != nil {
 		return err
 	}
 	c.rcpts = append(c.rcpts, to)
-	return nil
+	return c.stopAfter(StageRcpt)
+}
+
+// rcptCommand builds the RCPT command, with any ESMTP parameters
+func (c *Client) rcptCommand(to string) string {
+	params := withoutParams(c.dsnRcptParams(to), c.config.rcptParams)
+	return "RCPT TO:<" + to + ">" + params + c.extraParams("RCPT", c.config.rcptParams)
+}
+
+// encodeXtext encodes a parameter value as xtext, RFC 3461 section 4
+func encodeXtext(raw string) string {
+	var b strings.Builder
+	for i := 0; i < len(raw); i++ {
+		ch := raw[i]
+		if ch < '!' || ch > '~' || ch == '+' || ch == '=' {
+			fmt.Fprintf(&b, "+%02X", ch)
+			continue
+		}
+		b.WriteByte(ch)
+	}
+	return b.String()
 }
 
 type dataCloser struct {
@@ -318,7 +455,10 @@ func (d *dataCloser) Close() error {
 	d.c.conn.SetDeadline(time.Now().Add(d.c.config.Timeout))
 	defer d.c.conn.SetDeadline(time.Time{})
 
-	_, _, err := d.c.Text.ReadResponse(250)
+	if d.c.lmtp() {
+		return d.c.lmtpResponses()
+	}
+	_, _, err := d.c.ReadResponse(250)
 	return err
 }
 
@@ -367,10 +507,12 @@ func (c *Client) Quit() error {
 	if err := c.hello(); err != nil {
 		return err
 	}
+	start := time.Now()
 	_, _, err := c.cmd(221, StageNone, "QUIT")
 	if err != nil {
 		return err
 	}
+	c.latency("QUIT", start)
 	err = c.Text.Close()
 	return err
 }
@@ -384,28 +526,35 @@ func (c *Client) drop() error {
 	return ExitError{nil, ExitOk}
 }
 
-func (c *Client) dropAfterSend(stage Stage) error {
+// reached reports whether we've reached the stage the user asked
+// for. In a session that doesn't use STARTTLS the only EHLO is both
+// the first and the final one.
+func (c *Client) reached(want, stage Stage) bool {
 	if stage == StageNone {
-		return nil
+		return false
+	}
+	if want == stage {
+		return true
 	}
-	if c.config.DropAfterSend == stage {
+	return want == StageFirstHelo && stage == StageHelo && c.helloCount == 1
+}
+
+func (c *Client) dropAfterSend(stage Stage) error {
+	if c.reached(c.config.DropAfterSend, stage) {
 		return c.drop()
 	}
 	return nil
 }
 
 func (c *Client) stopAfter(stage Stage) error {
-	if stage == StageNone {
-		return nil
-	}
-	if c.config.QuitAfter == stage {
+	if c.reached(c.config.QuitAfter, stage) {
 		err := c.Quit()
 		if err != nil {
 			return err
 		}
 		return ExitError{nil, ExitOk}
 	}
-	if c.config.DropAfter == stage {
+	if c.reached(c.config.DropAfter, stage) {
 		return c.drop()
 	}
 	return nil
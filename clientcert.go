@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"os"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// clientCertRequest records whether the server asked us for a
+// client certificate during a handshake, and what we did about it
+type clientCertRequest struct {
+	requested     bool
+	acceptableCAs [][]byte
+	sent          *x509.Certificate
+	unsuitable    error
+}
+
+// clientCertificate returns a callback for tls.Config that offers
+// our client certificate, if we have one, and notes the request
+func (config Config) clientCertificate(req *clientCertRequest) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		req.requested = true
+		req.acceptableCAs = cri.AcceptableCAs
+		if config.clientCert == nil {
+			return &tls.Certificate{}, nil
+		}
+		req.unsuitable = cri.SupportsCertificate(config.clientCert)
+		req.sent = config.clientCert.Leaf
+		return config.clientCert, nil
+	}
+}
+
+func (config Config) reportClientCert(req clientCertRequest) {
+	if !req.requested {
+		if config.clientCert != nil {
+			config.Message(HintWarn, "  Server did not request a client certificate")
+		} else {
+			config.Message(HintInfo, "  Server did not request a client certificate")
+		}
+		return
+	}
+	config.Message(HintInfo, "  Server requested a client certificate")
+	if len(req.acceptableCAs) == 0 {
+		config.Message(HintInfo, "    Acceptable CAs: any")
+	}
+	for _, der := range req.acceptableCAs {
+		config.Messagef(HintInfo, "    Acceptable CA: %s", distinguishedName(der))
+	}
+	if req.sent == nil {
+		config.Message(HintWarn, "  No client certificate sent")
+		return
+	}
+	config.Messagef(HintInfo, "  Sent client certificate %s", req.sent.Subject)
+	if req.unsuitable != nil {
+		config.Messagef(HintWarn, "  Client certificate may not be acceptable to the server: %v", req.unsuitable)
+	}
+}
+
+// distinguishedName formats a DER encoded X.509 name
+func distinguishedName(der []byte) string {
+	var rdns pkix.RDNSequence
+	if _, err := asn1.Unmarshal(der, &rdns); err != nil {
+		return fmt.Sprintf("unparseable name (%v)", err)
+	}
+	var name pkix.Name
+	name.FillFromRDNSequence(&rdns)
+	return name.String()
+}
+
+// loadClientCert reads a client certificate and key, either as PEM
+// (in one file or two) or as a PKCS#12 bundle
+func loadClientCert(certFile, keyFile, password string) (*tls.Certificate, error) {
+	certData, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(certData, []byte("-----BEGIN")) {
+		key, leaf, chain, err := pkcs12.DecodeChain(certData, password)
+		if err != nil {
+			return nil, fmt.Errorf("while decoding PKCS#12 %s: %w", certFile, err)
+		}
+		cert := &tls.Certificate{
+			Certificate: [][]byte{leaf.Raw},
+			PrivateKey:  key,
+			Leaf:        leaf,
+		}
+		for _, ca := range chain {
+			cert.Certificate = append(cert.Certificate, ca.Raw)
+		}
+		return cert, nil
+	}
+
+	keyData := certData
+	if keyFile != "" {
+		keyData, err = os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cert, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
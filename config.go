@@ -3,11 +3,14 @@ package main
 //go:generate go run -modfile tools.mod github.com/dmarkham/enumer -type Stage -trimprefix Stage -json
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"github.com/fatih/color"
 	flag "github.com/spf13/pflag"
 	"io"
 	"net"
+	"net/url"
 	"os"
 	"os/user"
 	"strings"
@@ -72,16 +75,85 @@ type Config struct {
 	Size              int
 	SmtpUTF8          bool
 	UseStartTLS       bool
+	TLSOptional       bool
+	TLSOptionalStrict bool
+	TLSOnConnect      bool
+	TLSVerify         bool
+	TLSCAPath         string
+	TLSSNI            string
+	TLSPins           []string
+	TLSCert           string
+	TLSKey            string
+	TLSCertPassword   string `json:"-"`
+	DANE              bool
+	DNSServer         string
+	MTASTS            bool
+	MTASTSURL         string
+	Proxy             string
+	LocalInterface    string
+	LocalAddress      string
+	LocalPort         int
+	Protocol          string
+	BDAT              bool
+	BDATChunkSize     int
+	Auth              string
+	AuthUser          string
+	AuthPassword      string `json:"-"`
+	AuthToken         string `json:"-"`
+	AuthTokenFile     string
+	AuthTokenEnv      string
+	AuthTokenCommand  string
+	Xclient           []string
+	Xforward          []string
+	ProxyProtocol     string
+	ProxySource       string
+	ProxyDest         string
+	DSNRet            string
+	DSNEnvID          string
+	DSNNotify         string
+	DSNOrcpt          []string
+	DSNStrict         bool
+	RequireTLS        bool
+	ForceRequireTLS   bool
+	TLSRequiredNo     bool
+	MailParams        []string
+	RcptParams        []string
+	ForceParams       bool
+	SkipBadRcpts      bool
+	ReportJSON        string
+	StatusHints       string
+	Probe             bool
 
 	// Values we scan into, then process into what we want
-	dump          bool
-	quitAfter     string
-	dropAfter     string
-	dropAfterSend string
-	data          string
-	body          string
-	hideAll       bool
-	dumpMail      bool
+	dump           bool
+	quitAfter      string
+	dropAfter      string
+	dropAfterSend  string
+	data           string
+	body           string
+	hideAll        bool
+	dumpMail       bool
+	noTLSVerify    bool
+	rootCAs        *x509.CertPool
+	tlsPins        map[string]struct{}
+	clientCert     *tls.Certificate
+	dane           *daneRecords
+	tlsVerifySet   bool
+	quiet          bool // show nothing, for checks we only want the result of
+	proxyURL       *url.URL
+	authMechs      []string
+	authToken      string
+	xclient        []xattr
+	xforward       []xattr
+	proxyProtocol  int
+	proxySource    *net.TCPAddr
+	proxyDest      *net.TCPAddr
+	dsnOrcpt       map[string]string
+	mailParams     []xattr
+	rcptParams     []xattr
+	report         *Report
+	statusMeanings map[string]string
+	responseHints  []responseHint
 }
 
 var theme = []struct {
@@ -124,6 +196,8 @@ func (config *Config) flagSet() *flag.FlagSet {
 	fs.StringVar(&config.Helo, "ehlo", "", "Value to use for HELO")
 	fs.DurationVar(&config.Timeout, "timeout", 30*time.Second, "Timeout after this long")
 	fs.BoolVar(&config.Pipeline, "pipeline", false, "Use ESMTP pipelining")
+	fs.BoolVar(&config.BDAT, "bdat", false, "Send the message with BDAT if the server supports CHUNKING")
+	fs.IntVar(&config.BDATChunkSize, "bdat-chunk-size", 65536, "Maximum size of each BDAT chunk")
 	fs.StringVar(&config.Data, "data", defaultData, "Use the argument as the entire contents of DATA")
 	fs.StringVar(&config.Body, "body", "This is a test mailing.", "Specify the body of the email")
 	fs.BoolVar(&config.dump, "dump", false, "Dump configuration to stdout and exit")
@@ -152,6 +226,64 @@ func (config *Config) flagSet() *flag.FlagSet {
 	fs.IntVar(&config.Size, "size", 0, "Send SIZE ESMTP option")
 	fs.Lookup("size").NoOptDefVal = "-1"
 	fs.BoolVar(&config.SmtpUTF8, "smtputf8", false, "Request SMTPUTF8")
+	fs.BoolVar(&config.UseStartTLS, "tls", false, "Require STARTTLS, abort if it's not available")
+	fs.BoolVar(&config.TLSOptional, "tls-optional", false, "Use STARTTLS if offered, continue without TLS if it fails")
+	fs.BoolVar(&config.TLSOptional, "tlso", false, "Use STARTTLS if offered, continue without TLS if it fails")
+	fs.BoolVar(&config.TLSOptionalStrict, "tls-optional-strict", false, "Use STARTTLS if offered, abort if it fails")
+	fs.BoolVar(&config.TLSOptionalStrict, "tlsos", false, "Use STARTTLS if offered, abort if it fails")
+	fs.BoolVar(&config.TLSOnConnect, "tls-on-connect", false, "Start TLS immediately on connection (SMTPS)")
+	fs.BoolVar(&config.TLSOnConnect, "tlsc", false, "Start TLS immediately on connection (SMTPS)")
+	fs.BoolVar(&config.TLSVerify, "tls-verify", true, "Abort if the server certificate can't be verified")
+	fs.BoolVar(&config.noTLSVerify, "no-tls-verify", false, "Report certificate problems, but carry on regardless")
+	fs.StringVar(&config.TLSCAPath, "tls-ca-path", "", "PEM file or directory of CA certificates to trust instead of the system ones")
+	fs.StringVar(&config.TLSSNI, "tls-sni", "", "Server name to send in TLS SNI and verify against")
+	fs.StringArrayVar(&config.TLSPins, "tls-pin-spki", []string{}, "Require a certificate with this SHA-256 SPKI hash in the chain")
+	fs.StringVar(&config.TLSCert, "tls-cert", "", "Client certificate to present, PEM or PKCS#12")
+	fs.StringVar(&config.TLSKey, "tls-key", "", "Private key for a PEM --tls-cert, if it's not in the same file")
+	fs.StringVar(&config.TLSCertPassword, "tls-cert-password", "", "Password for a PKCS#12 --tls-cert")
+	fs.BoolVar(&config.DANE, "dane", false, "Check the server certificate against DANE TLSA records")
+	fs.StringVar(&config.DNSServer, "dns-server", "", "Send DNS queries to this server[:port] rather than the system resolver")
+	fs.BoolVar(&config.MTASTS, "mta-sts", false, "Apply the recipient domain's MTA-STS policy when routing by MX")
+	fs.StringVar(&config.MTASTSURL, "mta-sts-url", "", "Fetch MTA-STS policies from this URL, with %DOMAIN% replaced by the domain")
+	fs.StringVar(&config.Proxy, "proxy", "", "Connect through a socks5:// or http:// proxy, with optional user:password@")
+	fs.StringVar(&config.Protocol, "protocol", "smtp", "Protocol to speak, smtp or lmtp")
+	fs.StringVar(&config.LocalInterface, "local-interface", "", "Connect from an address on this network interface")
+	fs.StringVar(&config.LocalInterface, "li", "", "Connect from an address on this network interface")
+	fs.StringVar(&config.LocalAddress, "local-address", "", "Connect from this IP address")
+	fs.IntVar(&config.LocalPort, "local-port", 0, "Connect from this local port")
+	fs.IntVar(&config.LocalPort, "lp", 0, "Connect from this local port")
+	fs.StringVarP(&config.Auth, "auth", "a", "", "Authenticate, with the first of these comma-separated mechanisms the server offers (--auth=MECH,...)")
+	fs.StringVar(&config.Auth, "a", "", "Authenticate, with the first of these comma-separated mechanisms the server offers (--auth=MECH,...)")
+	fs.Lookup("auth").NoOptDefVal = "ANY"
+	fs.Lookup("a").NoOptDefVal = "ANY"
+	fs.StringVar(&config.AuthUser, "auth-user", "", "Username to authenticate with")
+	fs.StringVar(&config.AuthUser, "au", "", "Username to authenticate with")
+	fs.StringVar(&config.AuthPassword, "auth-password", "", "Password to authenticate with")
+	fs.StringVar(&config.AuthPassword, "ap", "", "Password to authenticate with")
+	fs.StringVar(&config.AuthToken, "auth-token", "", "OAuth bearer token for XOAUTH2 or OAUTHBEARER")
+	fs.StringVar(&config.AuthTokenFile, "auth-token-file", "", "Read the OAuth bearer token from this file")
+	fs.StringVar(&config.AuthTokenEnv, "auth-token-env", "", "Read the OAuth bearer token from this environment variable")
+	fs.StringVar(&config.AuthTokenCommand, "auth-token-command", "", "Run this shell command and use its output as the OAuth bearer token")
+	fs.StringArrayVar(&config.Xclient, "xclient", []string{}, "Send XCLIENT with this NAME=value attribute")
+	fs.StringArrayVar(&config.Xforward, "xforward", []string{}, "Send XFORWARD with this NAME=value attribute")
+	fs.StringVar(&config.ProxyProtocol, "proxy-protocol", "", "Send a HAProxy PROXY protocol header, v1 or v2, before the banner")
+	fs.StringVar(&config.ProxySource, "proxy-source", "", "Client ip:port to claim in the PROXY header, rather than our own")
+	fs.StringVar(&config.ProxyDest, "proxy-dest", "", "Server ip:port to claim in the PROXY header, rather than the real one")
+	fs.StringVar(&config.DSNRet, "dsn-ret", "", "Ask for DSNs to return the FULL message or just HDRS")
+	fs.StringVar(&config.DSNEnvID, "dsn-envid", "", "Envelope ID to include in DSNs")
+	fs.StringVar(&config.DSNNotify, "dsn-notify", "", "When to send DSNs, NEVER or a comma-separated list of SUCCESS, FAILURE and DELAY")
+	fs.StringArrayVar(&config.DSNOrcpt, "dsn-orcpt", []string{}, "Original recipient to send as ORCPT for one of the --to recipients, as rcpt=original")
+	fs.BoolVar(&config.DSNStrict, "dsn-strict", false, "Abort if the server doesn't support DSN, rather than leaving out DSN parameters")
+	fs.BoolVar(&config.RequireTLS, "require-tls", false, "Send REQUIRETLS, asking for TLS on every hop of delivery (RFC 8689)")
+	fs.BoolVar(&config.ForceRequireTLS, "force-require-tls", false, "Send REQUIRETLS even if the server certificate isn't verified")
+	fs.BoolVar(&config.TLSRequiredNo, "tls-required-no", false, "Add a TLS-Required: No header, asking for delivery even without TLS")
+	fs.StringArrayVar(&config.MailParams, "mail-param", []string{}, "Add this KEYWORD=value ESMTP parameter to MAIL, as given")
+	fs.StringArrayVar(&config.RcptParams, "rcpt-param", []string{}, "Add this KEYWORD=value ESMTP parameter to each RCPT, as given")
+	fs.BoolVar(&config.ForceParams, "force-params", false, "Send --mail-param and --rcpt-param parameters even if the server doesn't advertise them")
+	fs.BoolVar(&config.SkipBadRcpts, "skip-bad-rcpts", false, "Send the message to the recipients that were accepted, even if some were rejected")
+	fs.StringVar(&config.ReportJSON, "report-json", "", "Write a JSON report of the results to this file, or - for stdout")
+	fs.StringVar(&config.StatusHints, "status-hints", "", "File of extra status code meanings and response hints, each a code or regexp, a tab and an explanation")
+	fs.BoolVar(&config.Probe, "probe", false, "Report what the server offers, without sending mail (or use 'probe <host>')")
 	// TODO(steve) no-*-hints
 	return fs
 }
@@ -167,6 +299,25 @@ func (config *Config) ParseFlags(args []string) error {
 		}
 	}
 
+	config.tlsVerifySet = fs.Changed("tls-verify") || fs.Changed("no-tls-verify")
+
+	// mailspanner probe <host>
+	rest := fs.Args()
+	if len(rest) > 0 && rest[0] == "probe" {
+		config.Probe = true
+		rest = rest[1:]
+	}
+	if config.Probe {
+		if len(rest) == 1 && config.Server == "" {
+			config.Server = rest[0]
+			rest = rest[1:]
+		}
+		config.probeDefaults(fs)
+	}
+	if len(rest) > 0 {
+		return Fatalf(ExitFlags, "unexpected arguments: %s", strings.Join(rest, " "))
+	}
+
 	err = config.Normalize()
 	if err != nil {
 		return err
@@ -180,7 +331,13 @@ func (config *Config) ParseFlags(args []string) error {
 		encoder := json.NewEncoder(os.Stdout)
 		encoder.SetIndent("", "  ")
 		encoder.SetEscapeHTML(false)
-		_ = encoder.Encode(config)
+		dumped := *config
+		if config.proxyURL != nil {
+			// Secrets are tagged to be left out, but this one is
+			// part of a URL that's otherwise worth showing
+			dumped.Proxy = config.proxyURL.Redacted()
+		}
+		_ = encoder.Encode(dumped)
 		Exit(ExitOk)
 	}
 
@@ -224,6 +381,49 @@ func (config *Config) Normalize() error {
 		return err
 	}
 
+	tlsModes := 0
+	for _, set := range []bool{config.UseStartTLS, config.TLSOptional, config.TLSOptionalStrict} {
+		if set {
+			tlsModes++
+		}
+	}
+	if tlsModes > 1 {
+		return Fatalf(ExitFlags, "only one of --tls, --tls-optional and --tls-optional-strict may be given")
+	}
+	if tlsModes == 1 {
+		config.UseStartTLS = true
+	}
+	if config.UseStartTLS && config.TLSOnConnect {
+		return Fatalf(ExitFlags, "--tls-on-connect can't be combined with STARTTLS")
+	}
+	if config.noTLSVerify {
+		config.TLSVerify = false
+	}
+	if config.TLSCAPath != "" {
+		config.rootCAs, err = loadRootCAs(config.TLSCAPath)
+		if err != nil {
+			return Fatalf(ExitFlags, "while reading --tls-ca-path: %w", err)
+		}
+	}
+	if config.TLSCert != "" {
+		config.clientCert, err = loadClientCert(config.TLSCert, config.TLSKey, config.TLSCertPassword)
+		if err != nil {
+			return Fatalf(ExitFlags, "while reading --tls-cert: %w", err)
+		}
+	} else if config.TLSKey != "" {
+		return Fatalf(ExitFlags, "--tls-key requires --tls-cert")
+	}
+	if len(config.TLSPins) > 0 {
+		config.tlsPins = make(map[string]struct{}, len(config.TLSPins))
+		for _, pin := range config.TLSPins {
+			digest, err := parsePin(pin)
+			if err != nil {
+				return Fatalf(ExitFlags, "invalid value for --tls-pin-spki: %w", err)
+			}
+			config.tlsPins[string(digest)] = struct{}{}
+		}
+	}
+
 	if config.From == "<>" {
 		config.From = ""
 	} else if config.From == "" {
@@ -246,9 +446,105 @@ func (config *Config) Normalize() error {
 		config.Helo = host
 	}
 
-	if config.Server != "" {
+	if config.DNSServer != "" {
+		if !strings.Contains(config.DNSServer, ":") || net.ParseIP(config.DNSServer) != nil {
+			config.DNSServer = net.JoinHostPort(config.DNSServer, "53")
+		}
+	}
+
+	if err = config.normalizeLocal(); err != nil {
+		return err
+	}
+
+	if config.Proxy != "" {
+		config.proxyURL, err = parseProxy(config.Proxy)
+		if err != nil {
+			return Fatalf(ExitFlags, "invalid value for --proxy: %w", err)
+		}
+	}
+
+	if err = config.normalizeAuth(); err != nil {
+		return err
+	}
+
+	config.xclient, err = parseXattrs("--xclient", config.Xclient)
+	if err != nil {
+		return err
+	}
+	config.xforward, err = parseXattrs("--xforward", config.Xforward)
+	if err != nil {
+		return err
+	}
+
+	if config.TLSRequiredNo {
+		config.AdditionalHeaders = append(config.AdditionalHeaders, "TLS-Required: No")
+	}
+
+	if err = config.normalizeDSN(); err != nil {
+		return err
+	}
+	if config.StatusHints != "" {
+		if err = config.loadStatusHints(config.StatusHints); err != nil {
+			return Fatalf(ExitFlags, "while reading --status-hints: %w", err)
+		}
+	}
+	if config.ReportJSON != "" {
+		config.report = &Report{Recipients: []RcptResult{}}
+	}
+	config.mailParams, err = parseParams("--mail-param", config.MailParams)
+	if err != nil {
+		return err
+	}
+	config.rcptParams, err = parseParams("--rcpt-param", config.RcptParams)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(config.ProxyProtocol) {
+	case "":
+	case "v1", "1":
+		config.proxyProtocol = 1
+	case "v2", "2":
+		config.proxyProtocol = 2
+	default:
+		return Fatalf(ExitFlags, "invalid value for --proxy-protocol: '%s'", config.ProxyProtocol)
+	}
+	if config.ProxySource != "" {
+		config.proxySource, err = parseProxyAddr("--proxy-source", config.ProxySource)
+		if err != nil {
+			return err
+		}
+	}
+	if config.ProxyDest != "" {
+		config.proxyDest, err = parseProxyAddr("--proxy-dest", config.ProxyDest)
+		if err != nil {
+			return err
+		}
+	}
+
+	config.Protocol = strings.ToLower(config.Protocol)
+	switch config.Protocol {
+	case "smtp", "esmtp":
+		config.Protocol = "smtp"
+	case "lmtp":
+	default:
+		return Fatalf(ExitFlags, "invalid value for --protocol: '%s'", config.Protocol)
+	}
+
+	if config.Port == "" {
+		switch {
+		case config.Protocol == "lmtp":
+			config.Port = "24"
+		case config.TLSOnConnect:
+			config.Port = "465"
+		default:
+			config.Port = "25"
+		}
+	}
+
+	if config.Server != "" && !isUnixSocket(config.Server) {
 		if !strings.Contains(config.Server, ":") || net.ParseIP(config.Server) != nil {
-			config.Server = net.JoinHostPort(config.Server, "25")
+			config.Server = net.JoinHostPort(config.Server, config.Port)
 		}
 	}
 
@@ -263,9 +559,46 @@ func (config *Config) Normalize() error {
 }
 
 func (config *Config) Validate() error {
-	if len(config.To) == 0 {
+	if config.Probe {
+		if config.Server == "" {
+			return Fatalf(ExitFlags, "probe needs a server, use 'probe <host>' or --server")
+		}
+	} else if len(config.To) == 0 {
 		return Fatalf(ExitFlags, "at least one recipient must be given")
 	}
+	if config.BDATChunkSize < 1 {
+		return Fatalf(ExitFlags, "--bdat-chunk-size must be at least 1")
+	}
+	if config.Protocol == "lmtp" && config.Server == "" {
+		return Fatalf(ExitFlags, "--protocol lmtp requires --server")
+	}
+	if config.Auth != "" && config.AuthUser == "" {
+		return Fatalf(ExitFlags, "--auth requires --auth-user")
+	}
+	// DANE and MTA-STS may turn TLS on, mailCommand checks we have it
+	if config.RequireTLS && !config.UseStartTLS && !config.TLSOnConnect && !config.DANE && !config.MTASTS {
+		return Fatalf(ExitFlags, "--require-tls needs TLS, use --tls, --tls-optional-strict, --tls-on-connect, --dane or --mta-sts")
+	}
+	if config.RequireTLS && config.TLSRequiredNo {
+		return Fatalf(ExitFlags, "--require-tls and --tls-required-no contradict each other")
+	}
+	// RFC 8689 section 4.2.1
+	if config.RequireTLS && !config.TLSVerify && !config.ForceRequireTLS {
+		return Fatalf(ExitFlags, "--require-tls needs a verified certificate, use --force-require-tls to send it regardless")
+	}
+	// The header only reaches the message through %NEW_HEADERS%
+	if config.TLSRequiredNo && config.NoDataFixup {
+		return Fatalf(ExitFlags, "--tls-required-no can't add its header with --no-data-fixup")
+	}
+	if config.TLSRequiredNo && !strings.Contains(config.data, "%NEW_HEADERS%") {
+		return Fatalf(ExitFlags, "--tls-required-no needs %%NEW_HEADERS%% in --data to add its header")
+	}
+	if config.proxyProtocol == 0 && (config.proxySource != nil || config.proxyDest != nil) {
+		return Fatalf(ExitFlags, "--proxy-source and --proxy-dest require --proxy-protocol")
+	}
+	if isUnixSocket(config.Server) && config.proxyURL != nil {
+		return Fatalf(ExitFlags, "--proxy can't be used with a unix socket")
+	}
 	return nil
 }
 
@@ -273,7 +606,7 @@ func handleStage(name, input string) (Stage, error) {
 	if input == "" {
 		return StageNone, nil
 	}
-	s, err := StageString(strings.ToLower(input))
+	s, err := StageString(strings.ReplaceAll(strings.ToLower(input), "-", ""))
 	if err != nil {
 		return StageNone, Fatalf(ExitFlags, "invalid value for %s: '%s'", name, input)
 	}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// daneRecords are the TLSA records for an MX, as found in DNS
+type daneRecords struct {
+	name    string // the TLSA owner name, e.g. _25._tcp.mx.example.com
+	secure  bool   // whether the response was DNSSEC validated
+	domain  string // the next-hop domain the MX is for, if any
+	records []*dns.TLSA
+}
+
+// usable reports whether DANE applies to this host, as described in
+// RFC 7672 section 2.2
+func (d *daneRecords) usable() bool {
+	if d == nil || !d.secure {
+		return false
+	}
+	for _, r := range d.records {
+		if daneUsable(r) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupTLSA finds the TLSA records for host, reporting on what we
+// find. A lookup that fails, or that finds TLSA records we can't
+// validate, is an error: RFC 7672 section 2.2 says to defer delivery
+// rather than carry on without DANE.
+func (config Config) lookupTLSA(host, port string) (*daneRecords, error) {
+	d := &daneRecords{
+		name: fmt.Sprintf("_%s._tcp.%s", port, dns.Fqdn(host)),
+	}
+	resp, err := config.dnsQuery(d.name, dns.TypeTLSA)
+	if err != nil {
+		config.Messagef(HintError, "DANE: TLSA lookup for %s failed: %v", d.name, err)
+		return nil, fmt.Errorf("DANE: TLSA lookup for %s failed: %w", d.name, err)
+	}
+	d.secure = resp.AuthenticatedData
+	for _, rr := range resp.Answer {
+		if tlsa, ok := rr.(*dns.TLSA); ok {
+			d.records = append(d.records, tlsa)
+		}
+	}
+
+	if !d.secure {
+		if len(d.records) > 0 {
+			config.Messagef(HintError, "DANE: TLSA records for %s aren't DNSSEC validated (is the resolver validating?)", d.name)
+			return nil, fmt.Errorf("DANE: TLSA records for %s aren't DNSSEC validated", d.name)
+		}
+		config.Messagef(HintWarn, "DANE: %s is not DNSSEC-signed, DANE doesn't apply", host)
+		return d, nil
+	}
+	if len(d.records) == 0 {
+		config.Messagef(HintInfo, "DANE: no TLSA records at %s", d.name)
+		return d, nil
+	}
+	for _, r := range d.records {
+		if err := daneUsable(r); err != nil {
+			config.Messagef(HintWarn, "DANE: TLSA %s unusable: %v", tlsaString(r), err)
+		} else {
+			config.Messagef(HintInfo, "DANE: TLSA %s", tlsaString(r))
+		}
+	}
+	if !d.usable() {
+		config.Message(HintWarn, "DANE: no usable TLSA records, DANE doesn't apply")
+	}
+	return d, nil
+}
+
+// daneUsable checks whether a TLSA record can be used for SMTP
+func daneUsable(r *dns.TLSA) error {
+	switch r.Usage {
+	case 2, 3:
+	case 0, 1:
+		return fmt.Errorf("usage %d (PKIX) isn't used for SMTP, see RFC 7672 section 3.1.3", r.Usage)
+	default:
+		return fmt.Errorf("unknown usage %d", r.Usage)
+	}
+	if r.Selector > 1 {
+		return fmt.Errorf("unknown selector %d", r.Selector)
+	}
+	if r.MatchingType > 2 {
+		return fmt.Errorf("unknown matching type %d", r.MatchingType)
+	}
+	return nil
+}
+
+func tlsaString(r *dns.TLSA) string {
+	data := r.Certificate
+	if len(data) > 16 {
+		data = data[:16] + "..."
+	}
+	return fmt.Sprintf("%d %d %d %s", r.Usage, r.Selector, r.MatchingType, data)
+}
+
+// tlsaMatches reports whether cert matches the association data of r
+func tlsaMatches(r *dns.TLSA, cert *x509.Certificate) bool {
+	data, err := dns.CertificateToDANE(r.Selector, r.MatchingType, cert)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(data, r.Certificate)
+}
+
+// verifyDANE checks the certificate chain against each usable TLSA
+// record, as described in RFC 7672 section 3. It returns an error if
+// none of them match.
+func (config Config) verifyDANE(d *daneRecords, state tls.ConnectionState, host string) error {
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		config.Message(HintError, "DANE: no certificate presented")
+		return fmt.Errorf("DANE verification failed: no certificate presented")
+	}
+	passed := false
+	for _, r := range d.records {
+		if daneUsable(r) != nil {
+			continue
+		}
+		var err error
+		if r.Usage == 3 {
+			err = daneEE(r, certs)
+		} else {
+			err = daneTA(r, certs, d.names(host))
+		}
+		if err != nil {
+			config.Messagef(HintWarn, "DANE: TLSA %s fail: %v", tlsaString(r), err)
+			continue
+		}
+		config.Messagef(HintInfo, "DANE: TLSA %s pass", tlsaString(r))
+		passed = true
+	}
+	if !passed {
+		config.Message(HintError, "DANE: no TLSA record matches the certificate chain")
+		return fmt.Errorf("DANE verification failed for %s", host)
+	}
+	config.Message(HintInfo, "DANE: certificate chain authenticated")
+	return nil
+}
+
+// daneEE handles DANE-EE(3), where only the server certificate needs
+// to match. Names and expiry are deliberately ignored.
+func daneEE(r *dns.TLSA, certs []*x509.Certificate) error {
+	if tlsaMatches(r, certs[0]) {
+		return nil
+	}
+	return fmt.Errorf("server certificate doesn't match")
+}
+
+// names are the names a DANE-TA(2) server certificate may be issued
+// for, the MX hostname or the next-hop domain, RFC 7672 section 3.2.2
+func (d *daneRecords) names(host string) []string {
+	names := []string{strings.TrimSuffix(host, ".")}
+	domain := strings.TrimSuffix(d.domain, ".")
+	if domain != "" && !strings.EqualFold(domain, names[0]) {
+		names = append(names, domain)
+	}
+	return names
+}
+
+// daneTA handles DANE-TA(2), where some certificate in the chain is
+// the trust anchor, and the server certificate must chain to it and
+// be valid for one of names
+func daneTA(r *dns.TLSA, certs []*x509.Certificate, names []string) error {
+	var anchor *x509.Certificate
+	for _, cert := range certs {
+		if tlsaMatches(r, cert) {
+			anchor = cert
+			break
+		}
+	}
+	if anchor == nil {
+		return fmt.Errorf("no certificate in the chain matches")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(anchor)
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return fmt.Errorf("server certificate doesn't chain to %s: %s", anchor.Subject, describeVerifyError(err))
+	}
+	for _, name := range names {
+		if certs[0].VerifyHostname(name) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("server certificate isn't valid for %s", strings.Join(names, " or "))
+}
+
+// daneForHost looks up TLSA records for host, an MX for domain, if
+// --dane is in use. If DANE applies then TLS is mandatory, whatever
+// else we were asked. If we can't tell whether it applies we mustn't
+// deliver to host.
+func daneForHost(config Config, domain, host, addr string) (Config, error) {
+	if !config.DANE {
+		return config, nil
+	}
+	if net.ParseIP(host) != nil {
+		config.Message(HintWarn, "DANE: connecting to an IP address, not a hostname, DANE doesn't apply")
+		return config, nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		port = config.Port
+	}
+	d, err := config.lookupTLSA(host, port)
+	if err != nil {
+		return config, err
+	}
+	if !d.usable() {
+		return config, nil
+	}
+	d.domain = domain
+	config.dane = d
+	if !config.TLSOnConnect && (!config.UseStartTLS || config.TLSOptional || config.TLSOptionalStrict) {
+		config.Message(HintInfo, "DANE: TLS is mandatory for this host")
+		config.UseStartTLS = true
+		config.TLSOptional = false
+		config.TLSOptionalStrict = false
+	}
+	return config, nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testConfig parses a commandline the way main does, with enough
+// given that it needs nothing from the environment
+func testConfig(t *testing.T, args ...string) Config {
+	t.Helper()
+	var config Config
+	args = append([]string{"--hide-all", "--from", "sender@example.com", "--helo", "client.example.com", "--to", "rcpt@example.com"}, args...)
+	if err := config.ParseFlags(args); err != nil {
+		t.Fatalf("ParseFlags(%q): %v", args, err)
+	}
+	return config
+}
+
+// testCert makes a certificate for names, signed by parent (or self
+// signed if parent is nil)
+func testCert(t *testing.T, cn string, names []string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func testTLSA(t *testing.T, usage, selector, matching uint8, cert *x509.Certificate) *dns.TLSA {
+	t.Helper()
+	data, err := dns.CertificateToDANE(selector, matching, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &dns.TLSA{Usage: usage, Selector: selector, MatchingType: matching, Certificate: data}
+}
+
+func TestTLSAMatches(t *testing.T) {
+	cert, _ := testCert(t, "mx.example.com", []string{"mx.example.com"}, false, nil, nil)
+	other, _ := testCert(t, "other.example.com", []string{"other.example.com"}, false, nil, nil)
+
+	upper := testTLSA(t, 3, 1, 1, cert)
+	upper.Certificate = strings.ToUpper(upper.Certificate)
+
+	tests := []struct {
+		name string
+		r    *dns.TLSA
+		want bool
+	}{
+		{"full certificate", testTLSA(t, 3, 0, 0, cert), true},
+		{"certificate SHA-256", testTLSA(t, 3, 0, 1, cert), true},
+		{"certificate SHA-512", testTLSA(t, 3, 0, 2, cert), true},
+		{"SPKI", testTLSA(t, 3, 1, 0, cert), true},
+		{"SPKI SHA-256", testTLSA(t, 3, 1, 1, cert), true},
+		{"SPKI SHA-512", testTLSA(t, 3, 1, 2, cert), true},
+		{"upper case hex", upper, true},
+		{"other certificate", testTLSA(t, 3, 0, 1, other), false},
+		{"other SPKI", testTLSA(t, 3, 1, 1, other), false},
+		{"unknown matching type", &dns.TLSA{Usage: 3, Selector: 1, MatchingType: 3, Certificate: upper.Certificate}, false},
+		{"unknown selector", &dns.TLSA{Usage: 3, Selector: 2, MatchingType: 1, Certificate: upper.Certificate}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tlsaMatches(tt.r, cert); got != tt.want {
+				t.Errorf("tlsaMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDaneTA(t *testing.T) {
+	ca, caKey := testCert(t, "Test CA", nil, true, nil, nil)
+	intermediate, intermediateKey := testCert(t, "Test Intermediate", nil, true, ca, caKey)
+	leaf, _ := testCert(t, "mx.example.com", []string{"mx.example.com"}, false, intermediate, intermediateKey)
+	domainLeaf, _ := testCert(t, "example.com", []string{"example.com"}, false, intermediate, intermediateKey)
+	otherCA, _ := testCert(t, "Other CA", nil, true, nil, nil)
+
+	chain := []*x509.Certificate{leaf, intermediate, ca}
+	domainChain := []*x509.Certificate{domainLeaf, intermediate, ca}
+	mx := []string{"mx.example.com"}
+
+	tests := []struct {
+		name    string
+		r       *dns.TLSA
+		certs   []*x509.Certificate
+		names   []string
+		wantErr string
+	}{
+		{"root", testTLSA(t, 2, 0, 1, ca), chain, mx, ""},
+		{"root SPKI", testTLSA(t, 2, 1, 1, ca), chain, mx, ""},
+		{"intermediate", testTLSA(t, 2, 1, 1, intermediate), chain, mx, ""},
+		{"intermediate without root", testTLSA(t, 2, 0, 1, intermediate), chain[:2], mx, ""},
+		{"next-hop domain", testTLSA(t, 2, 0, 1, ca), domainChain, []string{"mx.example.com", "example.com"}, ""},
+		{"wrong host", testTLSA(t, 2, 0, 1, ca), chain, []string{"mx.example.net"}, "isn't valid for mx.example.net"},
+		{"wrong host and domain", testTLSA(t, 2, 0, 1, ca), chain, []string{"mx.example.net", "example.net"}, "isn't valid for mx.example.net or example.net"},
+		{"anchor not in chain", testTLSA(t, 2, 0, 1, otherCA), chain, mx, "no certificate in the chain matches"},
+		{"root not sent", testTLSA(t, 2, 0, 1, ca), chain[:2], mx, "no certificate in the chain matches"},
+		{"leaf doesn't chain", testTLSA(t, 2, 0, 1, ca), []*x509.Certificate{leaf, ca}, mx, "doesn't chain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := daneTA(tt.r, tt.certs, tt.names)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("daneTA() = %v, want success", err)
+			case tt.wantErr != "" && err == nil:
+				t.Errorf("daneTA() succeeded, want %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Errorf("daneTA() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDANENames(t *testing.T) {
+	tests := []struct {
+		domain string
+		host   string
+		want   []string
+	}{
+		{"", "mx.example.com.", []string{"mx.example.com"}},
+		{"example.com", "mx.example.com", []string{"mx.example.com", "example.com"}},
+		{"example.com.", "mx.example.com.", []string{"mx.example.com", "example.com"}},
+		{"Example.com", "example.com", []string{"example.com"}},
+	}
+	for _, tt := range tests {
+		d := &daneRecords{domain: tt.domain}
+		if got := d.names(tt.host); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("names(%q) with domain %q = %q, want %q", tt.host, tt.domain, got, tt.want)
+		}
+	}
+}
+
+// testZone is the response to one query, keyed by "name TYPE"
+type testZone struct {
+	rcode   int
+	secure  bool
+	answers []dns.RR
+}
+
+// testDNSServer answers queries from zone on 127.0.0.1, the way a
+// validating resolver would, and returns its address
+func testDNSServer(t *testing.T, zone map[string]testZone) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		key := dns.Fqdn(req.Question[0].Name) + " " + dns.TypeToString[req.Question[0].Qtype]
+		z, ok := zone[key]
+		if !ok {
+			m.Rcode = dns.RcodeNameError
+		} else {
+			m.Rcode = z.rcode
+			m.AuthenticatedData = z.secure
+			for _, rr := range z.answers {
+				rr.Header().Name = req.Question[0].Name
+				rr.Header().Rrtype = req.Question[0].Qtype
+				rr.Header().Class = dns.ClassINET
+				rr.Header().Ttl = 300
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		_ = w.WriteMsg(m)
+	})
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	<-started
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+	return pc.LocalAddr().String()
+}
+
+// TestDANE runs the whole of DANE verification against a stand-in
+// DNS server and a TLS server. The TLSA port is what tells the cases
+// apart, as httptest's certificate is only good for example.com.
+func TestDANE(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	cert := srv.Certificate()
+	other, _ := testCert(t, "example.com", []string{"example.com"}, false, nil, nil)
+
+	tlsa := func(usage, selector, matching uint8, cert *x509.Certificate) []dns.RR {
+		return []dns.RR{testTLSA(t, usage, selector, matching, cert)}
+	}
+	dnsAddr := testDNSServer(t, map[string]testZone{
+		"_25._tcp.example.com. TLSA":    {secure: true, answers: tlsa(3, 1, 1, cert)},
+		"_26._tcp.example.com. TLSA":    {secure: true, answers: tlsa(2, 0, 1, cert)},
+		"_27._tcp.example.com. TLSA":    {secure: true, answers: tlsa(3, 1, 1, other)},
+		"_28._tcp.example.com. TLSA":    {rcode: dns.RcodeServerFailure},
+		"_29._tcp.example.com. TLSA":    {secure: false, answers: tlsa(3, 1, 1, cert)},
+		"_30._tcp.example.com. TLSA":    {secure: true, answers: tlsa(0, 1, 1, cert)},
+		"_26._tcp.mx.example.net. TLSA": {secure: true, answers: tlsa(2, 0, 1, cert)},
+	})
+
+	tests := []struct {
+		name          string
+		domain        string
+		host          string
+		port          string
+		args          []string
+		wantLookupErr bool
+		wantDANE      bool
+		wantTLSErr    bool
+	}{
+		{name: "DANE-EE", port: "25", wantDANE: true},
+		{name: "DANE-TA", port: "26", wantDANE: true},
+		{name: "DANE-TA checks the MX host, not SNI", port: "26", args: []string{"--tls-sni", "sni.example.net"}, wantDANE: true},
+		{name: "DANE-TA accepts the next-hop domain", domain: "example.com", host: "mx.example.net", port: "26", wantDANE: true},
+		{name: "DANE-TA needs the host or domain", domain: "example.net", host: "mx.example.net", port: "26", wantDANE: true, wantTLSErr: true},
+		{name: "mismatch", port: "27", wantDANE: true, wantTLSErr: true},
+		{name: "SERVFAIL defers", port: "28", wantLookupErr: true},
+		{name: "unvalidated records defer", port: "29", wantLookupErr: true},
+		{name: "only PKIX usages", port: "30"},
+		{name: "unsigned", port: "31"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--dane", "--dns-server", dnsAddr, "--timeout", "5s"}, tt.args...)
+			config := testConfig(t, args...)
+			host := tt.host
+			if host == "" {
+				host = "example.com"
+			}
+			config, err := daneForHost(config, tt.domain, host, net.JoinHostPort("127.0.0.1", tt.port))
+			if tt.wantLookupErr {
+				if err == nil {
+					t.Fatal("daneForHost succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("daneForHost: %v", err)
+			}
+			if got := config.dane.usable(); got != tt.wantDANE {
+				t.Fatalf("DANE usable = %v, want %v", got, tt.wantDANE)
+			}
+			if !tt.wantDANE {
+				return
+			}
+			if !config.UseStartTLS || config.TLSOptional {
+				t.Error("DANE didn't make TLS mandatory")
+			}
+
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_, err = handshake(config, conn, config.tlsConfig("example.com"), host)
+			if tt.wantTLSErr && err == nil {
+				t.Error("handshake succeeded, want DANE failure")
+			}
+			if !tt.wantTLSErr && err != nil {
+				t.Errorf("handshake: %v", err)
+			}
+		})
+	}
+}
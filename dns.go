@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// resolver returns the resolver to use for MX and address lookups,
+// using --dns-server if it was given
+func (config Config) resolver() *net.Resolver {
+	res := &net.Resolver{
+		PreferGo: true,
+	}
+	if config.DNSServer != "" {
+		res.Dial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: config.Timeout}
+			return d.DialContext(ctx, network, config.DNSServer)
+		}
+	}
+	return res
+}
+
+// dnsServer returns the nameserver to send queries to directly
+func (config Config) dnsServer() (string, error) {
+	if config.DNSServer != "" {
+		return config.DNSServer, nil
+	}
+	cc, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return "", fmt.Errorf("can't find a nameserver, use --dns-server: %w", err)
+	}
+	if len(cc.Servers) == 0 {
+		return "", fmt.Errorf("no nameservers in /etc/resolv.conf, use --dns-server")
+	}
+	return net.JoinHostPort(cc.Servers[0], cc.Port), nil
+}
+
+// dnsQuery makes a DNSSEC aware query for name. The resolver we use
+// must be validating if we're to trust the AD bit in the response.
+func (config Config) dnsQuery(name string, qtype uint16) (*dns.Msg, error) {
+	server, err := config.dnsServer()
+	if err != nil {
+		return nil, err
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.SetEdns0(4096, true)
+	m.AuthenticatedData = true
+
+	client := dns.Client{Timeout: config.Timeout}
+	resp, _, err := client.Exchange(m, server)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.Exchange(m, server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("lookup of %s %s failed: %s", name, dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
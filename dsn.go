@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// normalizeDSN checks the --dsn-* options
+func (config *Config) normalizeDSN() error {
+	config.DSNRet = strings.ToUpper(config.DSNRet)
+	switch config.DSNRet {
+	case "", "FULL", "HDRS":
+	default:
+		return Fatalf(ExitFlags, "invalid value for --dsn-ret: '%s' should be FULL or HDRS", config.DSNRet)
+	}
+
+	if len(config.DSNEnvID) > 100 {
+		return Fatalf(ExitFlags, "invalid value for --dsn-envid: it may be at most 100 characters")
+	}
+	for _, ch := range config.DSNEnvID {
+		if ch < ' ' || ch > '~' {
+			return Fatalf(ExitFlags, "invalid value for --dsn-envid: it must be printable ASCII")
+		}
+	}
+
+	if config.DSNNotify != "" {
+		config.DSNNotify = strings.ToUpper(config.DSNNotify)
+		notify := strings.Split(config.DSNNotify, ",")
+		for _, n := range notify {
+			switch n {
+			case "NEVER":
+				if len(notify) > 1 {
+					return Fatalf(ExitFlags, "invalid value for --dsn-notify: NEVER can't be combined with anything else")
+				}
+			case "SUCCESS", "FAILURE", "DELAY":
+			default:
+				return Fatalf(ExitFlags, "invalid value for --dsn-notify: '%s' should be NEVER, SUCCESS, FAILURE or DELAY", n)
+			}
+		}
+	}
+
+	// Either address may contain "=", so look for the recipient
+	// rather than splitting on it
+	for _, o := range config.DSNOrcpt {
+		rcpt := ""
+		for _, to := range config.To {
+			if strings.HasPrefix(o, to+"=") && len(to) > len(rcpt) {
+				rcpt = to
+			}
+		}
+		if rcpt == "" {
+			return Fatalf(ExitFlags, "invalid value for --dsn-orcpt: '%s' should be rcpt=original, for a recipient given with --to", o)
+		}
+		orig := o[len(rcpt)+1:]
+		if orig == "" {
+			return Fatalf(ExitFlags, "invalid value for --dsn-orcpt: no original recipient for %s", rcpt)
+		}
+		if config.dsnOrcpt == nil {
+			config.dsnOrcpt = map[string]string{}
+		}
+		if _, ok := config.dsnOrcpt[rcpt]; ok {
+			return Fatalf(ExitFlags, "invalid value for --dsn-orcpt: %s given more than once", rcpt)
+		}
+		config.dsnOrcpt[rcpt] = orig
+	}
+	return nil
+}
+
+// wantDSN reports whether we've been asked for any DSN parameters
+func (config Config) wantDSN() bool {
+	return config.DSNRet != "" || config.DSNEnvID != "" || config.DSNNotify != "" || len(config.dsnOrcpt) > 0
+}
+
+// dsnMailParams returns the RFC 3461 parameters for MAIL, and
+// applies --dsn-strict if the server doesn't support them
+func (c *Client) dsnMailParams() (string, error) {
+	if !c.config.wantDSN() {
+		return "", nil
+	}
+	if _, ok := c.ext["DSN"]; !ok {
+		if c.config.DSNStrict {
+			c.Message(HintError, "Server doesn't advertise DSN")
+			return "", errors.New("smtp: server does not support DSN")
+		}
+		c.Message(HintWarn, "Server doesn't advertise DSN, not sending DSN parameters")
+		return "", nil
+	}
+	var params string
+	if c.config.DSNRet != "" {
+		params += " RET=" + c.config.DSNRet
+	}
+	if c.config.DSNEnvID != "" {
+		params += " ENVID=" + encodeXtext(c.config.DSNEnvID)
+	}
+	return params, nil
+}
+
+// dsnRcptParams returns the RFC 3461 parameters for RCPT
+func (c *Client) dsnRcptParams(to string) string {
+	if _, ok := c.ext["DSN"]; !ok {
+		// dsnMailParams has already complained
+		return ""
+	}
+	var params string
+	if c.config.DSNNotify != "" {
+		params += " NOTIFY=" + c.config.DSNNotify
+	}
+	if orig, ok := c.config.dsnOrcpt[to]; ok {
+		params += " ORCPT=" + c.orcpt(orig)
+	}
+	return params
+}
+
+// orcpt formats an original recipient for ORCPT. That's the RFC 3461
+// rfc822 address type, unless we're using SMTPUTF8 or the address
+// isn't ASCII, which need the utf-8 address type from RFC 6533.
+func (c *Client) orcpt(addr string) string {
+	switch {
+	case c.config.SmtpUTF8:
+		return "utf-8;" + encodeUTF8Addr(addr, true)
+	case !is7bit(addr):
+		return "utf-8;" + encodeUTF8Addr(addr, false)
+	}
+	return "rfc822;" + encodeXtext(addr)
+}
+
+// encodeUTF8Addr encodes an address as utf-8-addr-unitext, or as
+// utf-8-addr-xtext if unicode is false, RFC 6533 section 3
+func encodeUTF8Addr(addr string, unicode bool) string {
+	var b strings.Builder
+	for _, r := range addr {
+		switch {
+		case r >= 0x80 && unicode:
+			b.WriteRune(r)
+		case r < '!' || r > '~' || r == '\\' || r == '+' || r == '=':
+			fmt.Fprintf(&b, "\\x{%X}", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
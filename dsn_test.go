@@ -0,0 +1,126 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodeXtext(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"user@example.com", "user@example.com"},
+		{"user+tag@example.com", "user+2Btag@example.com"},
+		{"a=b", "a+3Db"},
+		{"two words", "two+20words"},
+		{"tab\there", "tab+09here"},
+		{"~!", "~!"},
+		{"caf\xc3\xa9", "caf+C3+A9"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := encodeXtext(tt.raw); got != tt.want {
+			t.Errorf("encodeXtext(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeUTF8Addr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		unicode bool
+		want    string
+	}{
+		{"user@example.com", false, "user@example.com"},
+		{"user+tag@example.com", true, "user\\x{2B}tag@example.com"},
+		{"a=b\\c", false, "a\\x{3D}b\\x{5C}c"},
+		{"two words", true, "two\\x{20}words"},
+		{"josé@example.com", true, "josé@example.com"},
+		{"josé@example.com", false, "jos\\x{E9}@example.com"},
+		{"用户@example.com", false, "\\x{7528}\\x{6237}@example.com"},
+	}
+	for _, tt := range tests {
+		if got := encodeUTF8Addr(tt.addr, tt.unicode); got != tt.want {
+			t.Errorf("encodeUTF8Addr(%q, %v) = %q, want %q", tt.addr, tt.unicode, got, tt.want)
+		}
+	}
+}
+
+func TestOrcpt(t *testing.T) {
+	tests := []struct {
+		addr string
+		args []string
+		want string
+	}{
+		{"orig+tag@example.com", nil, "rfc822;orig+2Btag@example.com"},
+		{"josé@example.com", nil, "utf-8;jos\\x{E9}@example.com"},
+		{"josé@example.com", []string{"--smtputf8"}, "utf-8;josé@example.com"},
+		{"orig+tag@example.com", []string{"--smtputf8"}, "utf-8;orig\\x{2B}tag@example.com"},
+	}
+	for _, tt := range tests {
+		c := testClient(t, nil, tt.args...)
+		if got := c.orcpt(tt.addr); got != tt.want {
+			t.Errorf("orcpt(%q) with %q = %q, want %q", tt.addr, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeDSN(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		wantOrcpt map[string]string
+		wantErr   string
+	}{
+		{name: "ret", args: []string{"--dsn-ret", "hdrs"}},
+		{name: "bad ret", args: []string{"--dsn-ret", "some"}, wantErr: "--dsn-ret"},
+		{name: "envid too long", args: []string{"--dsn-envid", strings.Repeat("x", 101)}, wantErr: "at most 100"},
+		{name: "envid not ASCII", args: []string{"--dsn-envid", "café"}, wantErr: "printable ASCII"},
+		{name: "notify", args: []string{"--dsn-notify", "success,delay"}},
+		{name: "NEVER combined", args: []string{"--dsn-notify", "never,failure"}, wantErr: "NEVER can't be combined"},
+		{name: "bad notify", args: []string{"--dsn-notify", "sometimes"}, wantErr: "'SOMETIMES'"},
+		{
+			name:      "orcpt",
+			args:      []string{"--dsn-orcpt", "rcpt@example.com=orig@example.org"},
+			wantOrcpt: map[string]string{"rcpt@example.com": "orig@example.org"},
+		},
+		{
+			name:      "orcpt with = in the addresses",
+			args:      []string{"--to", "a=b@example.com", "--dsn-orcpt", "a=b@example.com=c=d@example.org"},
+			wantOrcpt: map[string]string{"a=b@example.com": "c=d@example.org"},
+		},
+		{
+			name:      "orcpt for the longer recipient",
+			args:      []string{"--to", "rcpt@example.com=x", "--dsn-orcpt", "rcpt@example.com=x=orig@example.org"},
+			wantOrcpt: map[string]string{"rcpt@example.com=x": "orig@example.org"},
+		},
+		{name: "orcpt for someone else", args: []string{"--dsn-orcpt", "other@example.com=orig@example.org"}, wantErr: "for a recipient given with --to"},
+		{name: "orcpt without original", args: []string{"--dsn-orcpt", "rcpt@example.com="}, wantErr: "no original recipient"},
+		{
+			name:    "orcpt twice",
+			args:    []string{"--dsn-orcpt", "rcpt@example.com=a@example.org", "--dsn-orcpt", "rcpt@example.com=b@example.org"},
+			wantErr: "given more than once",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config Config
+			args := append([]string{"--hide-all", "--from", "sender@example.com", "--to", "rcpt@example.com"}, tt.args...)
+			err := config.ParseFlags(args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseFlags() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseFlags(): %v", err)
+			}
+			if !reflect.DeepEqual(config.dsnOrcpt, tt.wantOrcpt) {
+				t.Errorf("dsnOrcpt = %v, want %v", config.dsnOrcpt, tt.wantOrcpt)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// statusClasses are the meanings of the first part of an RFC 3463
+// enhanced status code
+var statusClasses = map[byte]string{
+	'2': "success",
+	'4': "temporary failure",
+	'5': "permanent failure",
+}
+
+// statusMeanings is the IANA registry of enhanced status codes,
+// https://www.iana.org/assignments/smtp-enhanced-status-codes
+var statusMeanings = map[string]string{
+	"X.0.0":  "Other undefined status",
+	"X.1.0":  "Other address status",
+	"X.1.1":  "Bad destination mailbox address",
+	"X.1.2":  "Bad destination system address",
+	"X.1.3":  "Bad destination mailbox address syntax",
+	"X.1.4":  "Destination mailbox address ambiguous",
+	"X.1.5":  "Destination address valid",
+	"X.1.6":  "Destination mailbox has moved, no forwarding address",
+	"X.1.7":  "Bad sender's mailbox address syntax",
+	"X.1.8":  "Bad sender's system address",
+	"X.1.9":  "Message relayed to non-compliant mailer",
+	"X.1.10": "Recipient address has null MX",
+	"X.2.0":  "Other or undefined mailbox status",
+	"X.2.1":  "Mailbox disabled, not accepting messages",
+	"X.2.2":  "Mailbox full",
+	"X.2.3":  "Message length exceeds administrative limit",
+	"X.2.4":  "Mailing list expansion problem",
+	"X.3.0":  "Other or undefined mail system status",
+	"X.3.1":  "Mail system full",
+	"X.3.2":  "System not accepting network messages",
+	"X.3.3":  "System not capable of selected features",
+	"X.3.4":  "Message too big for system",
+	"X.3.5":  "System incorrectly configured",
+	"X.3.6":  "Requested priority was changed",
+	"X.4.0":  "Other or undefined network or routing status",
+	"X.4.1":  "No answer from host",
+	"X.4.2":  "Bad connection",
+	"X.4.3":  "Directory server failure",
+	"X.4.4":  "Unable to route",
+	"X.4.5":  "Mail system congestion",
+	"X.4.6":  "Routing loop detected",
+	"X.4.7":  "Delivery time expired",
+	"X.5.0":  "Other or undefined protocol status",
+	"X.5.1":  "Invalid command",
+	"X.5.2":  "Syntax error",
+	"X.5.3":  "Too many recipients",
+	"X.5.4":  "Invalid command arguments",
+	"X.5.5":  "Wrong protocol version",
+	"X.5.6":  "Authentication exchange line is too long",
+	"X.6.0":  "Other or undefined media error",
+	"X.6.1":  "Media not supported",
+	"X.6.2":  "Conversion required and prohibited",
+	"X.6.3":  "Conversion required but not supported",
+	"X.6.4":  "Conversion with loss performed",
+	"X.6.5":  "Conversion failed",
+	"X.6.6":  "Message content not available",
+	"X.6.7":  "Non-ASCII addresses not permitted for that sender/recipient",
+	"X.6.8":  "UTF-8 string reply is required, but not permitted by the SMTP client",
+	"X.6.9":  "UTF-8 header message cannot be transferred to one or more recipients",
+	"X.7.0":  "Other or undefined security status",
+	"X.7.1":  "Delivery not authorized, message refused",
+	"X.7.2":  "Mailing list expansion prohibited",
+	"X.7.3":  "Security conversion required but not possible",
+	"X.7.4":  "Security features not supported",
+	"X.7.5":  "Cryptographic failure",
+	"X.7.6":  "Cryptographic algorithm not supported",
+	"X.7.7":  "Message integrity failure",
+	"X.7.8":  "Authentication credentials invalid",
+	"X.7.9":  "Authentication mechanism is too weak",
+	"X.7.10": "Encryption needed",
+	"X.7.11": "Encryption required for requested authentication mechanism",
+	"X.7.12": "A password transition is needed",
+	"X.7.13": "User account disabled",
+	"X.7.14": "Trust relationship required",
+	"X.7.15": "Priority level is too low",
+	"X.7.16": "Message is too big for the specified priority",
+	"X.7.17": "Mailbox owner has changed",
+	"X.7.18": "Domain owner has changed",
+	"X.7.19": "RRVS test cannot be completed",
+	"X.7.20": "No passing DKIM signature found",
+	"X.7.21": "No acceptable DKIM signature found",
+	"X.7.22": "No valid author-matched DKIM signature found",
+	"X.7.23": "SPF validation failed",
+	"X.7.24": "SPF validation error",
+	"X.7.25": "Reverse DNS validation failed",
+	"X.7.26": "Multiple authentication checks failed",
+	"X.7.27": "Sender address has null MX",
+	"X.7.28": "Mail flood detected",
+	"X.7.29": "ARC validation failure",
+	"X.7.30": "REQUIRETLS support required",
+}
+
+// responseHint explains a response that matches a pattern
+type responseHint struct {
+	re   *regexp.Regexp
+	hint string
+}
+
+// responseHints recognise the rejections of some large providers
+var responseHints = []responseHint{
+	// Gmail
+	{regexp.MustCompile(`(?i)p=NoSuchUser`), "Gmail: the mailbox doesn't exist"},
+	{regexp.MustCompile(`(?i)p=(OverQuotaTemp|OverQuotaPerm)|out of storage space`), "Gmail: the recipient's mailbox is full"},
+	{regexp.MustCompile(`(?i)p=UnsolicitedMessageError|likely unsolicited mail`), "Gmail: the message was classified as spam, check the content and the sender's reputation"},
+	{regexp.MustCompile(`(?i)p=UnsolicitedRateLimitError|unusual rate of unsolicited mail`), "Gmail: too much spam from this IP or domain, slow down and check Postmaster Tools"},
+	{regexp.MustCompile(`(?i)p=ReceivingRate|receiving mail at a rate`), "Gmail: the recipient is receiving too much mail, try again later"},
+	{regexp.MustCompile(`(?i)p=IPv6AuthError|IPv6 sending guidelines`), "Gmail: mail over IPv6 needs a PTR record and SPF or DKIM that passes, or send over IPv4"},
+	{regexp.MustCompile(`(?i)unauthenticated email .*not accepted|p=(DmarcRejection|UnauthenticatedEmail)`), "Gmail: the message failed SPF, DKIM or DMARC for the sender's domain"},
+	{regexp.MustCompile(`(?i)p=SenderRequirements|does not meet the (bulk )?sender requirements`), "Gmail: the sender doesn't meet Google's sender requirements for SPF, DKIM, DMARC and PTR"},
+
+	// Microsoft
+	{regexp.MustCompile(`(?i)\bS3150\b|\bS3140\b`), "Microsoft: the sending IP is on Microsoft's blocklist, request delisting at https://sender.office.com"},
+	{regexp.MustCompile(`5\.7\.606`), "Microsoft 365: the sending IP is banned, request delisting at https://sender.office.com"},
+	{regexp.MustCompile(`5\.7\.511`), "Microsoft 365: the sending IP is banned, and delisting needs a request to delist@microsoft.com"},
+	{regexp.MustCompile(`(?i)AS\(201806281\)`), "Microsoft 365: the recipient doesn't exist (directory based edge blocking)"},
+	{regexp.MustCompile(`5\.7\.708`), "Microsoft 365: mail from this IP isn't accepted because of its reputation"},
+	{regexp.MustCompile(`(?i)5\.7\.57 .*not authenticated`), "Microsoft 365: submission requires SMTP AUTH"},
+	{regexp.MustCompile(`(?i)5\.7\.139|SmtpClientAuthentication is disabled`), "Microsoft 365: SMTP AUTH is disabled for this tenant or mailbox"},
+	{regexp.MustCompile(`(?i)5\.7\.3 Authentication unsuccessful`), "Microsoft 365: wrong credentials, or basic authentication is disabled"},
+
+	// Yahoo and AOL
+	{regexp.MustCompile(`\[TSS04\]`), "Yahoo: deferred because of unexpected volume or user complaints, slow down"},
+	{regexp.MustCompile(`\[TSS09\]`), "Yahoo: deferred for a long time because of the sending IP's reputation"},
+	{regexp.MustCompile(`\[TSS11\]`), "Yahoo: too many unknown recipients from this IP"},
+	{regexp.MustCompile(`\[TS0[1-3]\]`), "Yahoo: temporarily deferred, retry later"},
+	{regexp.MustCompile(`\[BL2[0-9]\]`), "Yahoo: the sending IP is on a Spamhaus blocklist"},
+	{regexp.MustCompile(`(?i)5\.7\.9 .*DMARC`), "Yahoo: rejected because of the sender domain's DMARC policy"},
+
+	// Proofpoint
+	{regexp.MustCompile(`(?i)ipcheck\.proofpoint\.com`), "Proofpoint: the sending IP has a poor reputation, check and request delisting at https://ipcheck.proofpoint.com"},
+	{regexp.MustCompile(`(?i)header based Anti-Spoofing policy`), "Proofpoint: the recipient's anti-spoofing policy doesn't allow this server to send as the From domain"},
+	{regexp.MustCompile(`(?i)Message rejected by Proofpoint|blocked by Proofpoint`), "Proofpoint: rejected by the recipient's filtering policy"},
+
+	// Anyone
+	{regexp.MustCompile(`(?i)spamhaus\.org`), "the sending IP or domain is listed by Spamhaus, check https://check.spamhaus.org"},
+	{regexp.MustCompile(`(?i)spamcop\.net`), "the sending IP is listed by SpamCop, check https://www.spamcop.net/bl.shtml"},
+}
+
+var enhancedCodeRe = regexp.MustCompile(`^([245]\.[0-9]{1,3}\.[0-9]{1,3})(?: |$)`)
+
+// splitEnhancedCode separates an RFC 3463 enhanced status code from
+// the start of a response, if the server advertised ENHANCEDSTATUSCODES
+func (c *Client) splitEnhancedCode(msg string) (string, string) {
+	if _, ok := c.ext["ENHANCEDSTATUSCODES"]; !ok {
+		return "", msg
+	}
+	m := enhancedCodeRe.FindStringSubmatch(msg)
+	if m == nil {
+		return "", msg
+	}
+	return m[1], strings.TrimPrefix(msg[len(m[1]):], " ")
+}
+
+// statusMeaning describes an enhanced status code
+func (config Config) statusMeaning(code string) string {
+	generic := "X" + code[1:]
+	meaning, ok := config.statusMeanings[code]
+	if !ok {
+		meaning, ok = config.statusMeanings[generic]
+	}
+	if !ok {
+		meaning, ok = statusMeanings[code]
+	}
+	if !ok {
+		meaning, ok = statusMeanings[generic]
+	}
+	if !ok {
+		meaning = "Unregistered status code"
+	}
+	return fmt.Sprintf("%s (%s)", meaning, statusClasses[code[0]])
+}
+
+// explainResponse annotates a response with what its enhanced status
+// codes mean, and any hints for well-known rejections
+func (c *Client) explainResponse(code int, msg string) {
+	if code == 0 {
+		return
+	}
+	seen := map[string]bool{}
+	for _, line := range strings.Split(msg, "\n") {
+		enhanced, _ := c.splitEnhancedCode(line)
+		if enhanced == "" || seen[enhanced] {
+			continue
+		}
+		seen[enhanced] = true
+		c.Messagef(HintInfo, "  %s: %s", enhanced, c.config.statusMeaning(enhanced))
+	}
+	if code/100 == 2 || code/100 == 3 {
+		return
+	}
+	for _, hints := range [][]responseHint{c.config.responseHints, responseHints} {
+		for _, h := range hints {
+			if h.re.MatchString(msg) {
+				c.Messagef(HintWarn, "  Hint: %s", h.hint)
+			}
+		}
+	}
+}
+
+// loadStatusHints reads extra status code meanings and response
+// hints, which take precedence over the built-in ones. Each line is
+// a status code (like 5.7.26, or X.7.26 for any class) or a regular
+// expression to match against the response, then a tab, then the
+// explanation.
+func (config *Config) loadStatusHints(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	codeRe := regexp.MustCompile(`^[245X]\.[0-9]{1,3}\.[0-9]{1,3}$`)
+	config.statusMeanings = map[string]string{}
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		match, explanation, ok := strings.Cut(line, "\t")
+		explanation = strings.TrimSpace(explanation)
+		if !ok || explanation == "" {
+			return fmt.Errorf("line %d: expected a code or pattern, a tab, then an explanation", lineNo)
+		}
+		if codeRe.MatchString(match) {
+			config.statusMeanings[strings.ToUpper(match)] = explanation
+			continue
+		}
+		re, err := regexp.Compile(match)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		config.responseHints = append(config.responseHints, responseHint{re: re, hint: explanation})
+	}
+	return scanner.Err()
+}
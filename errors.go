@@ -5,3 +5,29 @@ type BailedError string
 func (e BailedError) Error() string {
 	return string(e)
 }
+
+// TLSError is a failure to negotiate TLS with the server
+type TLSError struct {
+	err error
+}
+
+func (e TLSError) Error() string {
+	return "TLS negotiation failed: " + e.err.Error()
+}
+
+func (e TLSError) Unwrap() error {
+	return e.err
+}
+
+// ProxyHeaderError is a failure to send a PROXY protocol header
+type ProxyHeaderError struct {
+	err error
+}
+
+func (e ProxyHeaderError) Error() string {
+	return "sending PROXY header failed: " + e.err.Error()
+}
+
+func (e ProxyHeaderError) Unwrap() error {
+	return e.err
+}
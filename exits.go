@@ -1,16 +1,41 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/textproto"
 	"os"
+	"syscall"
 )
 
 type ExitCode int
 
+// These follow swaks, so scripts written for it can tell what went wrong
 const (
-	ExitOk    ExitCode = 0
-	ExitFlags ExitCode = 1
-	ExitOther ExitCode = 100
+	ExitOk          ExitCode = 0
+	ExitFlags       ExitCode = 1
+	ExitConnect     ExitCode = 2  // couldn't connect to the server
+	ExitClosed      ExitCode = 6  // the server closed the connection outside any stage below
+	ExitTimeout     ExitCode = 7  // the server didn't respond in time
+	ExitBanner      ExitCode = 21 // the banner was a rejection
+	ExitHelo        ExitCode = 22 // HELO or EHLO was rejected
+	ExitMail        ExitCode = 23 // MAIL was rejected
+	ExitRcpt        ExitCode = 24 // a RCPT was rejected, or every one with --skip-bad-rcpts
+	ExitData        ExitCode = 25 // DATA was rejected
+	ExitDot         ExitCode = 26 // the message was rejected after it was sent
+	ExitAuth        ExitCode = 28 // authentication failed
+	ExitTLS         ExitCode = 29 // TLS failed
+	ExitHeloTLS     ExitCode = 32 // EHLO after STARTTLS was rejected
+	ExitXclient     ExitCode = 33 // XCLIENT or XFORWARD failed
+	ExitHeloXclient ExitCode = 34 // EHLO after XCLIENT was rejected
+	ExitProxy       ExitCode = 36 // sending the PROXY header failed
+	ExitOther       ExitCode = 100
+
+	// ExitTemporary is added to the code for a failure caused by a
+	// 4xx response, to tell it apart from a permanent rejection
+	ExitTemporary ExitCode = 20
 )
 
 type ExitError struct {
@@ -25,10 +50,74 @@ func (e ExitError) Error() string {
 	return e.err.Error()
 }
 
-func (e ExitError) UnWrap() error {
+func (e ExitError) Unwrap() error {
+	return e.err
+}
+
+// FailureError is a failure at a point in the session that has its
+// own exit code
+type FailureError struct {
+	err  error
+	exit ExitCode
+}
+
+func (e FailureError) Error() string {
+	return e.err.Error()
+}
+
+func (e FailureError) Unwrap() error {
 	return e.err
 }
 
+// failed records that err happened at a point in the session with
+// its own exit code, unless we already know where it happened
+func failed(exit ExitCode, err error) error {
+	if err == nil {
+		return nil
+	}
+	var failure FailureError
+	var ex ExitError
+	if errors.As(err, &failure) || errors.As(err, &ex) {
+		return err
+	}
+	return FailureError{err: err, exit: exit}
+}
+
+// exitCode picks the exit code for an error. A timeout has its own
+// code wherever it happens, but the connection closing during a stage
+// of the session that has its own code is reported as that stage
+// failing, as it's usually the server's way of refusing it.
+func exitCode(err error) ExitCode {
+	if err == nil {
+		return ExitOk
+	}
+	var ex ExitError
+	if errors.As(err, &ex) {
+		return ex.exit
+	}
+	var failure FailureError
+	isFailure := errors.As(err, &failure)
+	if isFailure && failure.exit == ExitConnect {
+		return ExitConnect
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ExitTimeout
+	}
+	if !isFailure {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+			errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, net.ErrClosed) {
+			return ExitClosed
+		}
+		return ExitOther
+	}
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) && tpErr.Code/100 == 4 {
+		return failure.exit + ExitTemporary
+	}
+	return failure.exit
+}
+
 func Exit(code ExitCode) {
 	os.Exit(int(code))
 }
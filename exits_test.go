@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testSMTPServer answers one SMTP or LMTP session on 127.0.0.1 and
+// returns its address, and a function that waits for the session to
+// end and returns the lines the client sent (without the message).
+// reply is given each command, and "." for the end of the message,
+// and returns the response, one line per "\n", or "" for the usual
+// one. A response of "CLOSE" closes the connection instead.
+func testSMTPServer(t *testing.T, ext []string, reply func(cmd string) string) (string, func() []string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var received []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		_ = l.Close()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		r := bufio.NewReader(conn)
+		write := func(resp string) bool {
+			if resp == "CLOSE" {
+				return false
+			}
+			for _, line := range strings.Split(resp, "\n") {
+				if _, err := fmt.Fprintf(conn, "%s\r\n", line); err != nil {
+					return false
+				}
+			}
+			return true
+		}
+		write("220 test.example.com ESMTP")
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			cmd := line
+			if inData {
+				if line != "." {
+					continue
+				}
+				inData = false
+			} else {
+				mu.Lock()
+				received = append(received, line)
+				mu.Unlock()
+			}
+			resp := reply(cmd)
+			verb := strings.ToUpper(strings.SplitN(cmd, " ", 2)[0])
+			if resp == "" {
+				switch verb {
+				case "EHLO", "LHLO":
+					resp = strings.Join(append(append([]string{"test.example.com"}, ext...), "HELP"), "\n")
+					lines := strings.Split(resp, "\n")
+					for i := range lines {
+						sep := "-"
+						if i == len(lines)-1 {
+							sep = " "
+						}
+						lines[i] = "250" + sep + lines[i]
+					}
+					resp = strings.Join(lines, "\n")
+				case "DATA":
+					resp = "354 go ahead"
+				case "QUIT":
+					resp = "221 bye"
+				default:
+					resp = "250 ok"
+				}
+			}
+			if verb == "DATA" && strings.HasPrefix(resp, "354") {
+				inData = true
+			}
+			if !write(resp) || verb == "QUIT" {
+				return
+			}
+		}
+	}()
+	return l.Addr().String(), func() []string {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("test server session didn't end")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return received
+	}
+}
+
+// testSend sends a message through a testSMTPServer the way main
+// does, and returns the error from the session
+func testSend(t *testing.T, addr string, args ...string) error {
+	t.Helper()
+	config := testConfig(t, append([]string{"--server", addr, "--timeout", "5s"}, args...)...)
+	payload, err := MakePayload(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return send(config, payload)
+}
+
+func TestExitCodeSession(t *testing.T) {
+	tests := []struct {
+		name  string
+		verb  string
+		reply string
+		want  ExitCode
+	}{
+		{"MAIL rejected", "MAIL", "550 5.7.1 go away", ExitMail},
+		{"MAIL deferred", "MAIL", "451 4.3.0 try later", ExitMail + ExitTemporary},
+		{"RCPT rejected", "RCPT", "550 5.1.1 no such user", ExitRcpt},
+		{"RCPT deferred", "RCPT", "450 4.2.1 mailbox busy", ExitRcpt + ExitTemporary},
+		{"DATA rejected", "DATA", "554 5.3.0 no", ExitData},
+		{"message deferred", ".", "452 4.3.1 full", ExitDot + ExitTemporary},
+		{"closed after the message", ".", "CLOSE", ExitDot},
+		{"closed at EHLO", "EHLO", "CLOSE", ExitHelo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, wait := testSMTPServer(t, nil, func(cmd string) string {
+				if strings.HasPrefix(strings.ToUpper(cmd), tt.verb) {
+					return tt.reply
+				}
+				return ""
+			})
+			err := testSend(t, addr)
+			wait()
+			if got := exitCode(err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", err, got, tt.want)
+			}
+		})
+	}
+}
+
+type testTimeout struct{}
+
+func (testTimeout) Error() string   { return "i/o timeout" }
+func (testTimeout) Timeout() bool   { return true }
+func (testTimeout) Temporary() bool { return true }
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ExitCode
+	}{
+		{"success", nil, ExitOk},
+		{"quit", ExitError{exit: ExitOk}, ExitOk},
+		{"flags", Fatalf(ExitFlags, "bad flag"), ExitFlags},
+		{"connect", failed(ExitConnect, syscall.ECONNREFUSED), ExitConnect},
+		{"timeout", failed(ExitRcpt, &net.OpError{Op: "read", Err: testTimeout{}}), ExitTimeout},
+		{"closed outside a stage", io.EOF, ExitClosed},
+		{"reset outside a stage", &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, ExitClosed},
+		{"closed during TLS", failed(ExitTLS, io.EOF), ExitTLS},
+		{"reset during AUTH", failed(ExitAuth, &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), ExitAuth},
+		{"broken pipe sending the message", failed(ExitDot, &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EPIPE)}), ExitDot},
+		{"first stage wins", failed(ExitRcpt, failed(ExitMail, &textproto.Error{Code: 550})), ExitMail},
+		{"permanent", failed(ExitHelo, &textproto.Error{Code: 554}), ExitHelo},
+		{"temporary", failed(ExitBanner, &textproto.Error{Code: 421}), ExitBanner + ExitTemporary},
+		{"other", errors.New("something else"), ExitOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"net/textproto"
+	"strings"
+)
+
+// lmtp reports whether we're speaking LMTP (RFC 2033) rather than SMTP
+func (c *Client) lmtp() bool {
+	return c.config.Protocol == "lmtp"
+}
+
+// isUnixSocket reports whether a --server is the path to a unix
+// domain socket rather than a host:port
+func isUnixSocket(server string) bool {
+	return strings.HasPrefix(server, "/") || strings.HasPrefix(server, "unix:")
+}
+
+// lmtpResponses reads the response for each recipient accepted, that
+// an LMTP server sends after the final dot. Each recipient succeeds
+// or fails on its own, so it only returns an error if the message
+// wasn't delivered to any of them.
+func (c *Client) lmtpResponses() error {
+	var firstErr error
+	delivered := 0
+	var results []RcptResult
+	for _, rcpt := range c.rcpts {
+		code, msg, err := c.ReadResponse(250)
+		if err != nil {
+			var tpErr *textproto.Error
+			if !errors.As(err, &tpErr) {
+				return err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			delivered++
+		}
+		results = append(results, c.rcptResult(rcpt, code, msg))
+	}
+	for _, r := range results {
+		text := r.Text
+		if r.EnhancedCode != "" {
+			text = r.EnhancedCode + " " + text
+		}
+		c.Messagef(rcptHint(r.Code), "%s: %d %s", r.Address, r.Code, text)
+	}
+	if c.config.report != nil {
+		c.config.report.Deliveries = append(c.config.report.Deliveries, results...)
+	}
+	if delivered == 0 {
+		return firstErr
+	}
+	if firstErr != nil {
+		c.Messagef(HintWarn, "Message delivered to %d of %d recipients", delivered, len(results))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestLMTPResponses checks each response after the final dot is
+// matched with the recipient it's for, skipping those refused at RCPT
+func TestLMTPResponses(t *testing.T) {
+	type delivery struct {
+		Address string
+		Code    int
+	}
+	tests := []struct {
+		name    string
+		args    []string
+		rcpt    map[string]string
+		dot     string
+		want    ExitCode
+		results []delivery
+	}{
+		{
+			name:    "all delivered",
+			dot:     "250 2.0.0 ok\n250 2.0.0 ok\n250 2.0.0 ok",
+			want:    ExitOk,
+			results: []delivery{{"rcpt@example.com", 250}, {"b@example.com", 250}, {"c@example.com", 250}},
+		},
+		{
+			name:    "some delivered",
+			dot:     "250 2.0.0 ok\n552 5.2.2 mailbox full\n451 4.3.0 try later",
+			want:    ExitOk,
+			results: []delivery{{"rcpt@example.com", 250}, {"b@example.com", 552}, {"c@example.com", 451}},
+		},
+		{
+			name:    "multiline response",
+			dot:     "552 5.2.2 mailbox full\n250-2.0.0 ok\n250 2.0.0 really\n550 5.1.1 gone",
+			want:    ExitOk,
+			results: []delivery{{"rcpt@example.com", 552}, {"b@example.com", 250}, {"c@example.com", 550}},
+		},
+		{
+			name:    "none delivered",
+			dot:     "552 5.2.2 mailbox full\n550 5.1.1 gone\n451 4.3.0 try later",
+			want:    ExitDot,
+			results: []delivery{{"rcpt@example.com", 552}, {"b@example.com", 550}, {"c@example.com", 451}},
+		},
+		{
+			name:    "first failure deferred",
+			dot:     "451 4.3.0 try later\n552 5.2.2 mailbox full\n550 5.1.1 gone",
+			want:    ExitDot + ExitTemporary,
+			results: []delivery{{"rcpt@example.com", 451}, {"b@example.com", 552}, {"c@example.com", 550}},
+		},
+		{
+			name:    "one refused at RCPT",
+			args:    []string{"--skip-bad-rcpts"},
+			rcpt:    map[string]string{"RCPT TO:<b@example.com>": "550 5.1.1 no such user"},
+			dot:     "250 2.0.0 ok\n452 4.2.2 over quota",
+			want:    ExitOk,
+			results: []delivery{{"rcpt@example.com", 250}, {"c@example.com", 452}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, wait := testSMTPServer(t, nil, func(cmd string) string {
+				if cmd == "." {
+					return tt.dot
+				}
+				return tt.rcpt[cmd]
+			})
+			args := append([]string{"--server", addr, "--timeout", "5s", "--protocol", "lmtp", "--to", "b@example.com,c@example.com"}, tt.args...)
+			config := testConfig(t, append(args, "--report-json", t.TempDir()+"/report.json")...)
+			payload, err := MakePayload(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testOutput(t, func() {
+				err = send(config, payload)
+			})
+			received := wait()
+
+			if len(received) == 0 || received[0] != "LHLO client.example.com" {
+				t.Errorf("session started with %q, want LHLO", received)
+			}
+			if got := exitCode(err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", err, got, tt.want)
+			}
+			var results []delivery
+			for _, r := range config.report.Deliveries {
+				results = append(results, delivery{r.Address, r.Code})
+			}
+			if !reflect.DeepEqual(results, tt.results) {
+				t.Errorf("deliveries = %+v, want %+v", results, tt.results)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// localAddr returns the source address to connect from, given by
+// --local-address, --local-interface and --local-port. When an
+// interface has addresses of both families we pick the one that
+// matches the destination.
+func (config Config) localAddr(network, addr string) (*net.TCPAddr, error) {
+	if config.LocalAddress == "" && config.LocalInterface == "" && config.LocalPort == 0 {
+		return nil, nil
+	}
+	local := &net.TCPAddr{Port: config.LocalPort}
+	if config.LocalAddress != "" {
+		local.IP = net.ParseIP(config.LocalAddress)
+		return local, nil
+	}
+	if config.LocalInterface == "" {
+		return local, nil
+	}
+
+	wantV4, wantV6 := network != "tcp6", network != "tcp4"
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			wantV4 = ip.To4() != nil
+			wantV6 = !wantV4
+		}
+	}
+	ips, err := interfaceAddrs(config.LocalInterface)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		isV4 := ip.To4() != nil
+		if (isV4 && wantV4) || (!isV4 && wantV6) {
+			local.IP = ip
+			return local, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no suitable address to reach %s", config.LocalInterface, addr)
+}
+
+// localFamilies reports which address families we can connect from,
+// given --local-address or --local-interface
+func (config Config) localFamilies() (v4, v6 bool) {
+	var ips []net.IP
+	switch {
+	case config.LocalAddress != "":
+		ips = []net.IP{net.ParseIP(config.LocalAddress)}
+	case config.LocalInterface != "":
+		var err error
+		ips, err = interfaceAddrs(config.LocalInterface)
+		if err != nil {
+			// We'll find out why when we try to connect
+			return true, true
+		}
+	default:
+		return true, true
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = true
+		} else {
+			v6 = true
+		}
+	}
+	return v4, v6
+}
+
+// interfaceAddrs lists the usable addresses of a network interface.
+// IPv6 link-local addresses are no use for sending mail, so are skipped.
+func interfaceAddrs(name string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, ipNet.IP)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("interface %s has no usable addresses", name)
+	}
+	return ips, nil
+}
+
+// normalizeLocal checks --local-interface and --local-address. For
+// compatibility with SWAKS --local-interface may also be an address.
+func (config *Config) normalizeLocal() error {
+	if config.LocalInterface != "" && net.ParseIP(config.LocalInterface) != nil {
+		if config.LocalAddress != "" {
+			return Fatalf(ExitFlags, "only one of --local-interface and --local-address may be given")
+		}
+		config.LocalAddress = config.LocalInterface
+		config.LocalInterface = ""
+	}
+	if config.LocalAddress != "" {
+		if config.LocalInterface != "" {
+			return Fatalf(ExitFlags, "only one of --local-interface and --local-address may be given")
+		}
+		if net.ParseIP(config.LocalAddress) == nil {
+			return Fatalf(ExitFlags, "invalid value for --local-address: '%s' is not an IP address", config.LocalAddress)
+		}
+	}
+	if config.LocalInterface != "" {
+		if _, err := interfaceAddrs(config.LocalInterface); err != nil {
+			return Fatalf(ExitFlags, "invalid value for --local-interface: %w", err)
+		}
+	}
+	if config.LocalPort < 0 || config.LocalPort > 65535 {
+		return Fatalf(ExitFlags, "invalid value for --local-port: %d", config.LocalPort)
+	}
+	return nil
+}
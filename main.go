@@ -19,20 +19,30 @@ func main() {
 		Fatal(err)
 	}
 
-	payload, err := MakePayload(c)
-	if err != nil {
-		Fatal(err)
+	if c.Probe {
+		err = probe(c)
+	} else {
+		var payload string
+		payload, err = MakePayload(c)
+		if err != nil {
+			Fatal(err)
+		}
+		if c.dumpMail {
+			fmt.Println(payload)
+			Exit(ExitOk)
+		}
+		err = send(c, payload)
 	}
-	if c.dumpMail {
-		fmt.Println(payload)
-		Exit(ExitOk)
+	if reportErr := c.writeReport(); reportErr != nil {
+		Fatal(reportErr)
 	}
-	err = send(c, payload)
 	if err != nil {
 		var tpErr *textproto.Error
-		if !errors.As(err, &tpErr) {
-			Fatal(err)
+		if errors.As(err, &tpErr) {
+			// The transcript already shows what the server said
+			Exit(exitCode(err))
 		}
+		Fatal(err)
 	}
 	Exit(ExitOk)
 }
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// stsPolicy is an MTA-STS policy, as described in RFC 8461 section 3.2
+type stsPolicy struct {
+	ID     string
+	Mode   string
+	MX     []string
+	MaxAge int
+}
+
+// stsTXTRecord finds the policy id in the _mta-sts TXT record for a domain
+func stsTXTRecord(ctx context.Context, res *net.Resolver, domain string) (string, error) {
+	txts, err := res.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		return "", err
+	}
+	var ids []string
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=STSv1") {
+			continue
+		}
+		for _, field := range strings.Split(txt, ";") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) == 2 && kv[0] == "id" {
+				ids = append(ids, kv[1])
+			}
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return "", errors.New("no v=STSv1 record")
+	case 1:
+		return ids[0], nil
+	}
+	return "", errors.New("more than one v=STSv1 record")
+}
+
+// fetchSTSPolicy looks for an MTA-STS policy for domain. It returns nil
+// if there isn't one, or if it can't be retrieved, which RFC 8461 says
+// should be treated the same way.
+func (config Config) fetchSTSPolicy(ctx context.Context, res *net.Resolver, domain string) *stsPolicy {
+	id, err := stsTXTRecord(ctx, res, domain)
+	if err != nil {
+		if config.MTASTSURL == "" {
+			config.Messagef(HintInfo, "MTA-STS: no policy for %s: %v", domain, err)
+			return nil
+		}
+		config.Messagef(HintWarn, "MTA-STS: no _mta-sts record for %s: %v", domain, err)
+	} else {
+		config.Messagef(HintInfo, "MTA-STS: _mta-sts.%s has policy id %s", domain, id)
+	}
+
+	url := "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+	if config.MTASTSURL != "" {
+		url = strings.ReplaceAll(config.MTASTSURL, "%DOMAIN%", domain)
+	}
+	config.Messagef(HintInfo, "MTA-STS: fetching %s", url)
+	policy, err := config.getSTSPolicy(ctx, url)
+	if err != nil {
+		config.Messagef(HintWarn, "MTA-STS: failed to fetch policy: %v", err)
+		return nil
+	}
+	policy.ID = id
+	config.Messagef(HintInfo, "MTA-STS: mode %s, max_age %d, mx %s", policy.Mode, policy.MaxAge, strings.Join(policy.MX, ", "))
+	return policy
+}
+
+func (config Config) getSTSPolicy(ctx context.Context, url string) (*stsPolicy, error) {
+	client := http.Client{
+		Timeout: config.Timeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{
+				RootCAs: config.rootCAs,
+			},
+		},
+		// RFC 8461 section 3.3, redirects must not be followed
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		config.Messagef(HintWarn, "MTA-STS: policy has content type '%s', not text/plain", ct)
+	}
+	// RFC 8461 section 3.2 suggests a 64k limit on policy size
+	return parseSTSPolicy(io.LimitReader(resp.Body, 64*1024))
+}
+
+func parseSTSPolicy(r io.Reader) (*stsPolicy, error) {
+	policy := &stsPolicy{MaxAge: -1}
+	version := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed policy line '%s'", line)
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "version":
+			version = value
+		case "mode":
+			policy.Mode = value
+		case "mx":
+			policy.MX = append(policy.MX, strings.ToLower(value))
+		case "max_age":
+			age, err := strconv.Atoi(value)
+			if err != nil || age < 0 {
+				return nil, fmt.Errorf("invalid max_age '%s'", value)
+			}
+			policy.MaxAge = age
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if version != "STSv1" {
+		return nil, fmt.Errorf("policy version is '%s', not STSv1", version)
+	}
+	switch policy.Mode {
+	case "enforce", "testing":
+		if len(policy.MX) == 0 {
+			return nil, fmt.Errorf("%s policy has no mx entries", policy.Mode)
+		}
+	case "none":
+	default:
+		return nil, fmt.Errorf("invalid mode '%s'", policy.Mode)
+	}
+	if policy.MaxAge == -1 {
+		return nil, errors.New("policy has no max_age")
+	}
+	return policy, nil
+}
+
+// matches checks an MX hostname against the policy's mx patterns,
+// as described in RFC 8461 section 4.1
+func (p *stsPolicy) matches(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		if strings.HasPrefix(pattern, "*.") {
+			dot := strings.IndexByte(host, '.')
+			if dot > 0 && host[dot+1:] == pattern[2:] {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// apply checks an MX against the policy, and returns the configuration
+// to use when delivering to it. It returns false if we mustn't deliver
+// to that MX at all.
+func (p *stsPolicy) apply(config Config, host string) (Config, bool) {
+	if p == nil || p.Mode == "none" {
+		return config, true
+	}
+	if p.matches(host) {
+		config.Messagef(HintInfo, "MTA-STS: %s matches the policy", host)
+	} else if p.Mode == "enforce" {
+		config.Messagef(HintError, "MTA-STS: %s doesn't match the policy, skipping it", host)
+		return config, false
+	} else {
+		config.Messagef(HintWarn, "MTA-STS: %s doesn't match the policy", host)
+	}
+
+	if config.TLSOnConnect {
+		if p.Mode == "enforce" {
+			config.TLSVerify = true
+		}
+		return config, true
+	}
+	switch p.Mode {
+	case "enforce":
+		// TLS with a valid certificate is mandatory
+		config.UseStartTLS = true
+		config.TLSOptional = false
+		config.TLSOptionalStrict = false
+		config.TLSVerify = true
+	case "testing":
+		// Report problems, but deliver regardless, unless we've
+		// been told what to do about the certificate
+		if !config.UseStartTLS {
+			config.UseStartTLS = true
+			config.TLSOptional = true
+		}
+		if !config.tlsVerifySet {
+			config.TLSVerify = false
+		}
+	}
+	return config, true
+}
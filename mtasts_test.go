@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseSTSPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		want    *stsPolicy
+		wantErr string
+	}{
+		{
+			name:   "enforce",
+			policy: "version: STSv1\nmode: enforce\nmx: mail.example.com\nmx: *.example.net\nmax_age: 604800\n",
+			want:   &stsPolicy{Mode: "enforce", MX: []string{"mail.example.com", "*.example.net"}, MaxAge: 604800},
+		},
+		{
+			name:   "testing with CRLF",
+			policy: "version: STSv1\r\nmode: testing\r\nmx: mail.example.com\r\nmax_age: 86400\r\n",
+			want:   &stsPolicy{Mode: "testing", MX: []string{"mail.example.com"}, MaxAge: 86400},
+		},
+		{
+			name:   "none needs no mx",
+			policy: "version: STSv1\nmode: none\nmax_age: 0\n",
+			want:   &stsPolicy{Mode: "none", MaxAge: 0},
+		},
+		{
+			name:   "mx is lower cased",
+			policy: "version: STSv1\nmode: enforce\nmx: *.Example.COM\nmax_age: 1\n",
+			want:   &stsPolicy{Mode: "enforce", MX: []string{"*.example.com"}, MaxAge: 1},
+		},
+		{
+			name:   "unknown keys and blank lines",
+			policy: "version: STSv1\n\nmode: enforce\nextension: whatever\nmx: mail.example.com\nmax_age: 1\n",
+			want:   &stsPolicy{Mode: "enforce", MX: []string{"mail.example.com"}, MaxAge: 1},
+		},
+		{
+			name:    "missing version",
+			policy:  "mode: enforce\nmx: mail.example.com\nmax_age: 1\n",
+			wantErr: "not STSv1",
+		},
+		{
+			name:    "bad version",
+			policy:  "version: STSv2\nmode: enforce\nmx: mail.example.com\nmax_age: 1\n",
+			wantErr: "not STSv1",
+		},
+		{
+			name:    "bad mode",
+			policy:  "version: STSv1\nmode: strict\nmx: mail.example.com\nmax_age: 1\n",
+			wantErr: "invalid mode",
+		},
+		{
+			name:    "missing mode",
+			policy:  "version: STSv1\nmx: mail.example.com\nmax_age: 1\n",
+			wantErr: "invalid mode",
+		},
+		{
+			name:    "enforce without mx",
+			policy:  "version: STSv1\nmode: enforce\nmax_age: 1\n",
+			wantErr: "no mx entries",
+		},
+		{
+			name:    "negative max_age",
+			policy:  "version: STSv1\nmode: enforce\nmx: mail.example.com\nmax_age: -1\n",
+			wantErr: "invalid max_age",
+		},
+		{
+			name:    "non-numeric max_age",
+			policy:  "version: STSv1\nmode: enforce\nmx: mail.example.com\nmax_age: forever\n",
+			wantErr: "invalid max_age",
+		},
+		{
+			name:    "missing max_age",
+			policy:  "version: STSv1\nmode: enforce\nmx: mail.example.com\n",
+			wantErr: "no max_age",
+		},
+		{
+			name:    "malformed line",
+			policy:  "version: STSv1\nmode enforce\n",
+			wantErr: "malformed policy line",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSTSPolicy(strings.NewReader(tt.policy))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseSTSPolicy() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSTSPolicy(): %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSTSPolicy() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSTSPolicyMatches(t *testing.T) {
+	policy := &stsPolicy{Mode: "enforce", MX: []string{"mail.example.com", "*.example.net"}}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"mail.example.com", true},
+		{"MAIL.Example.Com", true},
+		{"mail.example.com.", true},
+		{"mx.example.com", false},
+		{"mail.example.com.evil.com", false},
+		{"mx1.example.net", true},
+		{"mx1.example.net.", true},
+		{"example.net", false},
+		{"a.b.example.net", false},
+		{".example.net", false},
+	}
+	for _, tt := range tests {
+		if got := policy.matches(tt.host); got != tt.want {
+			t.Errorf("matches(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestSTSPolicyApply(t *testing.T) {
+	tests := []struct {
+		name          string
+		mode          string
+		args          []string
+		host          string
+		wantOK        bool
+		wantStartTLS  bool
+		wantOptional  bool
+		wantTLSVerify bool
+	}{
+		{name: "enforce", mode: "enforce", host: "mail.example.com", wantOK: true, wantStartTLS: true, wantTLSVerify: true},
+		{name: "enforce overrides --no-tls-verify", mode: "enforce", args: []string{"--no-tls-verify"}, host: "mail.example.com", wantOK: true, wantStartTLS: true, wantTLSVerify: true},
+		{name: "enforce skips other MX", mode: "enforce", host: "mx.example.org"},
+		{name: "testing", mode: "testing", host: "mail.example.com", wantOK: true, wantStartTLS: true, wantOptional: true},
+		{name: "testing delivers to other MX", mode: "testing", host: "mx.example.org", wantOK: true, wantStartTLS: true, wantOptional: true},
+		{name: "testing keeps --tls-verify", mode: "testing", args: []string{"--tls-verify"}, host: "mail.example.com", wantOK: true, wantStartTLS: true, wantOptional: true, wantTLSVerify: true},
+		{name: "testing keeps --tls", mode: "testing", args: []string{"--tls"}, host: "mail.example.com", wantOK: true, wantStartTLS: true},
+		{name: "none", mode: "none", host: "mx.example.org", wantOK: true, wantTLSVerify: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &stsPolicy{Mode: tt.mode, MX: []string{"mail.example.com"}, MaxAge: 86400}
+			config, ok := policy.apply(testConfig(t, tt.args...), tt.host)
+			if ok != tt.wantOK {
+				t.Fatalf("apply() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if config.UseStartTLS != tt.wantStartTLS {
+				t.Errorf("UseStartTLS = %v, want %v", config.UseStartTLS, tt.wantStartTLS)
+			}
+			if config.TLSOptional != tt.wantOptional {
+				t.Errorf("TLSOptional = %v, want %v", config.TLSOptional, tt.wantOptional)
+			}
+			if config.TLSVerify != tt.wantTLSVerify {
+				t.Errorf("TLSVerify = %v, want %v", config.TLSVerify, tt.wantTLSVerify)
+			}
+		})
+	}
+}
+
+// TestFetchSTSPolicy fetches policies from a stand-in HTTPS server,
+// with the _mta-sts TXT records served by a stand-in DNS server
+func TestFetchSTSPolicy(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/example.com/mta-sts.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("version: STSv1\nmode: enforce\nmx: mail.example.com\nmax_age: 86400\n"))
+	})
+	mux.HandleFunc("/redirect.example/mta-sts.txt", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/example.com/mta-sts.txt", http.StatusFound)
+	})
+	mux.HandleFunc("/broken.example/mta-sts.txt", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("version: STSv1\nmode: sometimes\n"))
+	})
+	srv := httptest.NewTLSServer(mux)
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, pemData, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	txt := func(s string) []dns.RR {
+		return []dns.RR{&dns.TXT{Txt: []string{s}}}
+	}
+	dnsAddr := testDNSServer(t, map[string]testZone{
+		"_mta-sts.example.com. TXT":       {answers: txt("v=STSv1; id=20240101T000000")},
+		"_mta-sts.redirect.example. TXT":  {answers: txt("v=STSv1; id=1")},
+		"_mta-sts.broken.example. TXT":    {answers: txt("v=STSv1; id=1")},
+		"_mta-sts.unrelated.example. TXT": {answers: txt("v=spf1 -all")},
+	})
+
+	config := testConfig(t, "--mta-sts", "--dns-server", dnsAddr, "--tls-ca-path", caFile, "--timeout", "5s",
+		"--mta-sts-url", srv.URL+"/%DOMAIN%/mta-sts.txt")
+	res := config.resolver()
+
+	tests := []struct {
+		domain string
+		want   *stsPolicy
+	}{
+		{"example.com", &stsPolicy{ID: "20240101T000000", Mode: "enforce", MX: []string{"mail.example.com"}, MaxAge: 86400}},
+		{"redirect.example", nil},
+		{"broken.example", nil},
+		{"missing.example", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			got := config.fetchSTSPolicy(context.Background(), res, tt.domain)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fetchSTSPolicy() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// Without --mta-sts-url a domain without a TXT record has no policy,
+	// and we don't go looking for one
+	config.MTASTSURL = ""
+	if got := config.fetchSTSPolicy(context.Background(), res, "unrelated.example"); got != nil {
+		t.Errorf("fetchSTSPolicy() = %+v for a domain with no _mta-sts record", got)
+	}
+}
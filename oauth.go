@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// oauthAuth is XOAUTH2, as used by Google and Microsoft, or its
+// standardised successor RFC 7628 OAUTHBEARER
+type oauthAuth struct {
+	config   Config
+	mech     string
+	username string
+	token    string
+	step     int
+}
+
+func (a *oauthAuth) Start(server *ServerInfo) (string, []byte, string, error) {
+	if a.token == "" {
+		return a.mech, nil, "", errors.New("no OAuth token given")
+	}
+	prefix := "user=" + a.username + "\x01auth=Bearer "
+	if a.mech == "OAUTHBEARER" {
+		prefix = "n,a=" + scramName(a.username) + ",\x01host=" + server.Name + "\x01auth=Bearer "
+	}
+	const suffix = "\x01\x01"
+	return a.mech, []byte(prefix + a.token + suffix), prefix + redacted + suffix, nil
+}
+
+func (a *oauthAuth) Next(fromServer []byte, more bool) ([]byte, string, error) {
+	if !more {
+		return nil, "", nil
+	}
+	a.step++
+	if a.step > 1 {
+		return nil, "", errors.New("unexpected server challenge")
+	}
+	// The only challenge is an error, which we acknowledge so the
+	// server can send the real failure response
+	a.reportError(fromServer)
+	if a.mech == "XOAUTH2" {
+		return []byte{}, "", nil
+	}
+	return []byte("\x01"), "\x01", nil
+}
+
+// reportError shows the JSON error the server sends when it
+// rejects a token, RFC 7628 section 3.2.2
+func (a *oauthAuth) reportError(payload []byte) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		a.config.Messagef(HintWarn, "  %s: server error isn't valid JSON: %v", a.mech, err)
+		return
+	}
+	a.config.Messagef(HintError, "  %s: server rejected the token:", a.mech)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		a.config.Messagef(HintError, "    %s: %v", k, fields[k])
+	}
+}
+
+// authTokenSources are --auth-token, --auth-token-file,
+// --auth-token-env and --auth-token-command
+func (config Config) authTokenSources() []string {
+	var sources []string
+	for _, s := range []string{config.AuthToken, config.AuthTokenFile, config.AuthTokenEnv, config.AuthTokenCommand} {
+		if s != "" {
+			sources = append(sources, s)
+		}
+	}
+	return sources
+}
+
+// haveAuthToken reports whether we've been told where to find an
+// OAuth bearer token
+func (config Config) haveAuthToken() bool {
+	return len(config.authTokenSources()) > 0
+}
+
+// checkAuthToken checks we've been given at most one source for the
+// OAuth bearer token
+func (config Config) checkAuthToken() error {
+	if len(config.authTokenSources()) > 1 {
+		return Fatalf(ExitFlags, "only one of --auth-token, --auth-token-file, --auth-token-env and --auth-token-command may be given")
+	}
+	return nil
+}
+
+// loadAuthToken finds the OAuth bearer token from whichever of
+// --auth-token, --auth-token-file, --auth-token-env or
+// --auth-token-command we've been given. It waits until we've
+// chosen a mechanism that needs the token, so that the command
+// doesn't run for sessions that never authenticate.
+func (config *Config) loadAuthToken() error {
+	switch {
+	case config.AuthToken != "":
+		config.authToken = config.AuthToken
+	case config.AuthTokenFile != "":
+		b, err := os.ReadFile(config.AuthTokenFile)
+		if err != nil {
+			return fmt.Errorf("while reading --auth-token-file: %w", err)
+		}
+		config.authToken = strings.TrimSpace(string(b))
+	case config.AuthTokenEnv != "":
+		config.authToken = strings.TrimSpace(os.Getenv(config.AuthTokenEnv))
+		if config.authToken == "" {
+			return fmt.Errorf("environment variable %s from --auth-token-env is empty", config.AuthTokenEnv)
+		}
+	case config.AuthTokenCommand != "":
+		cmd := exec.Command("sh", "-c", config.AuthTokenCommand)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("while running --auth-token-command: %w", err)
+		}
+		config.authToken = strings.TrimSpace(string(out))
+	default:
+		return errors.New("no OAuth token given")
+	}
+	if config.authToken == "" {
+		return errors.New("OAuth token is empty")
+	}
+	if strings.ContainsAny(config.authToken, "\x01\r\n") {
+		return errors.New("OAuth token contains control characters")
+	}
+	return nil
+}
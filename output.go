@@ -1,7 +1,6 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"github.com/fatih/color"
 	"regexp"
@@ -46,14 +45,10 @@ func Errorf(msg string, args ...interface{}) {
 }
 
 func Fatal(err error) {
-	if !errors.Is(err, nil) {
+	if err.Error() != "" {
 		Error(err)
 	}
-	var ex ExitError
-	if errors.As(err, &ex) {
-		Exit(ex.exit)
-	}
-	Exit(ExitOther)
+	Exit(exitCode(err))
 }
 
 func Warn(msg string) {
@@ -87,6 +82,9 @@ func (c *Client) Message(hint Hint, msg string) {
 }
 
 func (config Config) Message(hint Hint, msg string) {
+	if config.quiet {
+		return
+	}
 	showHint := true
 	switch hint {
 	case HintInfo:
@@ -103,7 +101,7 @@ func (config Config) Message(hint Hint, msg string) {
 		if config.NoSendHints {
 			showHint = false
 		}
-	case HintRecv, HintRecvTls, HintRecvQ, HintRecvTlsQ, HintRecvChunk:
+	case HintRecv, HintRecvTls, HintRecvQ, HintRecvTlsQ, HintRecvChunk, HintAccept, HintReject, HintDefer:
 		if config.HideReceive {
 			return
 		}
@@ -116,7 +114,8 @@ func (config Config) Message(hint Hint, msg string) {
 	lines := lineEndRE.Split(msg, -1)
 	for _, line := range lines {
 		textColor := t.Color
-		if hint == HintRecv || hint == HintRecvTls {
+		switch hint {
+		case HintRecv, HintRecvTls, HintRecvQ, HintRecvTlsQ, HintRecvChunk:
 			switch {
 			case acceptRe.MatchString(line):
 				textColor = config.Colors[HintAccept].Color
@@ -135,7 +134,7 @@ func (config Config) Message(hint Hint, msg string) {
 }
 
 func (c *Client) Messagef(hint Hint, msg string, args ...interface{}) {
-	c.config.Messagef(hint, msg, args...)
+	c.Message(hint, fmt.Sprintf(msg, args...))
 }
 
 func (config Config) Messagef(hint Hint, msg string, args ...interface{}) {
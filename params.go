@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+)
+
+// paramExtensions maps MAIL and RCPT parameters to the extension
+// that provides them, where the names differ
+var paramExtensions = map[string]string{
+	"BODY":      "8BITMIME",
+	"RET":       "DSN",
+	"ENVID":     "DSN",
+	"NOTIFY":    "DSN",
+	"ORCPT":     "DSN",
+	"BY":        "DELIVERBY",
+	"HOLDFOR":   "FUTURERELEASE",
+	"HOLDUNTIL": "FUTURERELEASE",
+	"RRVS":      "RRVS",
+}
+
+// paramExtension returns the extensions the server must advertise
+// before we can send p
+func paramExtension(p xattr) []string {
+	if p.name == "BODY" && strings.EqualFold(p.value, "BINARYMIME") {
+		// RFC 3030 section 3
+		return []string{"BINARYMIME", "CHUNKING"}
+	}
+	if ext, ok := paramExtensions[p.name]; ok {
+		return []string{ext}
+	}
+	return []string{p.name}
+}
+
+// parseParams parses the KEYWORD=value, or bare KEYWORD, ESMTP
+// parameters given to flag
+func parseParams(flag string, args []string) ([]xattr, error) {
+	var params []xattr
+	for _, arg := range args {
+		name, value, _ := strings.Cut(arg, "=")
+		if name == "" || strings.ContainsAny(arg, " \t\r\n") {
+			return nil, Fatalf(ExitFlags, "invalid value for %s: '%s' should be KEYWORD=value", flag, arg)
+		}
+		params = append(params, xattr{name: strings.ToUpper(name), value: value})
+	}
+	return params, nil
+}
+
+// withoutParams removes from the parameters we'd send anyway any
+// that the user has given their own value for
+func withoutParams(auto string, params []xattr) string {
+	var s string
+	for _, f := range strings.Fields(auto) {
+		name, _, _ := strings.Cut(f, "=")
+		if !hasParam(params, strings.ToUpper(name)) {
+			s += " " + f
+		}
+	}
+	return s
+}
+
+// hasParam reports whether name is one of params
+func hasParam(params []xattr, name string) bool {
+	for _, p := range params {
+		if p.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// extraParams formats the --mail-param or --rcpt-param parameters,
+// leaving out any the server doesn't advertise unless we've been
+// told to send them anyway. It only warns about each once a session.
+func (c *Client) extraParams(verb string, params []xattr) string {
+	var s string
+	for _, p := range params {
+		missing := ""
+		for _, ext := range paramExtension(p) {
+			if _, ok := c.ext[ext]; !ok {
+				missing = ext
+				break
+			}
+		}
+		if missing != "" {
+			c.paramWarning(verb, p.name, missing)
+			if !c.config.ForceParams {
+				continue
+			}
+		}
+		s += " " + p.name
+		if p.value != "" {
+			s += "=" + p.value
+		}
+	}
+	return s
+}
+
+// paramWarning warns, once a session, that the server hasn't
+// advertised ext, which the name parameter to verb needs
+func (c *Client) paramWarning(verb, name, ext string) {
+	key := verb + " " + name
+	if _, ok := c.paramWarnings[key]; ok {
+		return
+	}
+	if c.paramWarnings == nil {
+		c.paramWarnings = map[string]struct{}{}
+	}
+	c.paramWarnings[key] = struct{}{}
+	if c.config.ForceParams {
+		c.Messagef(HintWarn, "Server doesn't advertise %s, sending %s parameter %s anyway", ext, verb, name)
+	} else {
+		c.Messagef(HintWarn, "Server doesn't advertise %s, not sending %s parameter %s", ext, verb, name)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fatih/color"
+)
+
+// testOutput collects what's written to the terminal while f runs
+func testOutput(t *testing.T, f func()) string {
+	t.Helper()
+	var buf bytes.Buffer
+	saved := color.Output
+	color.Output = &buf
+	defer func() {
+		color.Output = saved
+	}()
+	f()
+	return buf.String()
+}
+
+// testClient is a client for a session with a server that advertised
+// ext, without a connection
+func testClient(t *testing.T, ext []string, args ...string) *Client {
+	t.Helper()
+	c := &Client{config: testConfig(t, args...), ext: map[string]string{}}
+	for _, e := range ext {
+		name, value, _ := strings.Cut(e, " ")
+		c.ext[name] = value
+	}
+	return c
+}
+
+func TestParseParams(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    []xattr
+		wantErr bool
+	}{
+		{[]string{"MT-PRIORITY=3"}, []xattr{{name: "MT-PRIORITY", value: "3"}}, false},
+		{[]string{"holdfor=60", "smtputf8"}, []xattr{{name: "HOLDFOR", value: "60"}, {name: "SMTPUTF8"}}, false},
+		{[]string{"X-VENDOR=a=b"}, []xattr{{name: "X-VENDOR", value: "a=b"}}, false},
+		{[]string{"=3"}, nil, true},
+		{[]string{"BY=60 R"}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseParams("--mail-param", tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseParams(%q) error = %v, want error %v", tt.args, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseParams(%q) = %+v, want %+v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestParamExtension(t *testing.T) {
+	tests := []struct {
+		p    xattr
+		want []string
+	}{
+		{xattr{name: "BODY", value: "8BITMIME"}, []string{"8BITMIME"}},
+		{xattr{name: "BODY", value: "binarymime"}, []string{"BINARYMIME", "CHUNKING"}},
+		{xattr{name: "NOTIFY", value: "NEVER"}, []string{"DSN"}},
+		{xattr{name: "HOLDFOR", value: "60"}, []string{"FUTURERELEASE"}},
+		{xattr{name: "MT-PRIORITY", value: "3"}, []string{"MT-PRIORITY"}},
+	}
+	for _, tt := range tests {
+		if got := paramExtension(tt.p); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("paramExtension(%+v) = %q, want %q", tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestMailCommand(t *testing.T) {
+	ext := []string{"8BITMIME", "SIZE 1000000", "DSN", "SMTPUTF8", "MT-PRIORITY"}
+	tests := []struct {
+		name string
+		ext  []string
+		args []string
+		want string
+	}{
+		{"automatic", ext, []string{"--size=100", "--dsn-ret", "hdrs"}, "MAIL FROM:<sender@example.com> BODY=8BITMIME SIZE=100 RET=HDRS"},
+		{"extra", ext, []string{"--mail-param", "MT-PRIORITY=3"}, "MAIL FROM:<sender@example.com> BODY=8BITMIME MT-PRIORITY=3"},
+		{"BODY replaced", ext, []string{"--mail-param", "BODY=7BIT"}, "MAIL FROM:<sender@example.com> BODY=7BIT"},
+		{"SIZE replaced", ext, []string{"--size=100", "--mail-param", "SIZE=5"}, "MAIL FROM:<sender@example.com> BODY=8BITMIME SIZE=5"},
+		{"RET and ENVID replaced", ext, []string{"--dsn-ret", "FULL", "--dsn-envid", "abc", "--mail-param", "ret=HDRS", "--mail-param", "ENVID=xyz"},
+			"MAIL FROM:<sender@example.com> BODY=8BITMIME RET=HDRS ENVID=xyz"},
+		{"SMTPUTF8 not repeated", ext, []string{"--smtputf8", "--mail-param", "SMTPUTF8"}, "MAIL FROM:<sender@example.com> BODY=8BITMIME SMTPUTF8"},
+		{"not advertised", []string{"8BITMIME"}, []string{"--mail-param", "MT-PRIORITY=3"}, "MAIL FROM:<sender@example.com> BODY=8BITMIME"},
+		{"forced", []string{"8BITMIME"}, []string{"--mail-param", "MT-PRIORITY=3", "--force-params"}, "MAIL FROM:<sender@example.com> BODY=8BITMIME MT-PRIORITY=3"},
+		{"BINARYMIME needs CHUNKING", []string{"8BITMIME", "BINARYMIME"}, []string{"--mail-param", "BODY=BINARYMIME"}, "MAIL FROM:<sender@example.com>"},
+		{"BINARYMIME", []string{"8BITMIME", "BINARYMIME", "CHUNKING"}, []string{"--mail-param", "BODY=BINARYMIME"}, "MAIL FROM:<sender@example.com> BODY=BINARYMIME"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testClient(t, tt.ext, tt.args...)
+			var got string
+			var err error
+			testOutput(t, func() {
+				got, err = c.mailCommand("sender@example.com")
+			})
+			if err != nil {
+				t.Fatalf("mailCommand: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("mailCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRcptCommand(t *testing.T) {
+	ext := []string{"DSN", "RRVS"}
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"automatic", []string{"--dsn-notify", "failure,delay", "--dsn-orcpt", "rcpt@example.com=orig@example.com"},
+			"RCPT TO:<rcpt@example.com> NOTIFY=FAILURE,DELAY ORCPT=rfc822;orig@example.com"},
+		{"NOTIFY replaced", []string{"--dsn-notify", "SUCCESS", "--rcpt-param", "NOTIFY=NEVER"}, "RCPT TO:<rcpt@example.com> NOTIFY=NEVER"},
+		{"ORCPT replaced", []string{"--dsn-orcpt", "rcpt@example.com=orig@example.com", "--rcpt-param", "ORCPT=rfc822;x@example.com"},
+			"RCPT TO:<rcpt@example.com> ORCPT=rfc822;x@example.com"},
+		{"extra", []string{"--rcpt-param", "RRVS=2014-04-03T23:01:00Z"}, "RCPT TO:<rcpt@example.com> RRVS=2014-04-03T23:01:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testClient(t, ext, tt.args...)
+			if got := c.rcptCommand("rcpt@example.com"); got != tt.want {
+				t.Errorf("rcptCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParamWarnedOnce(t *testing.T) {
+	c := testClient(t, nil, "--rcpt-param", "MT-PRIORITY=3")
+	out := testOutput(t, func() {
+		for _, to := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+			if got, want := c.rcptCommand(to), "RCPT TO:<"+to+">"; got != want {
+				t.Errorf("rcptCommand() = %q, want %q", got, want)
+			}
+		}
+	})
+	if n := strings.Count(out, "doesn't advertise MT-PRIORITY"); n != 1 {
+		t.Errorf("warned %d times, want once:\n%s", n, out)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/textproto"
+	"time"
+)
+
+// pipelined is one command in a PIPELINING batch
+type pipelined struct {
+	stage  Stage
+	expect int
+	exit   ExitCode
+	cmd    string
+	id     uint
+}
+
+// pipelineTransaction sends MAIL, every RCPT and DATA as a single batch,
+// as described in RFC 2920, then reads the responses back in order.
+// If we've been asked to stop at one of those stages the batch ends
+// there.
+func (c *Client) pipelineTransaction(from string, recipients []string) (io.WriteCloser, error) {
+	mailCmd, err := c.mailCommand(from)
+	if err != nil {
+		return nil, failed(ExitMail, err)
+	}
+	batch := []pipelined{{stage: StageMail, expect: 250, exit: ExitMail, cmd: mailCmd}}
+	for _, to := range recipients {
+		batch = append(batch, pipelined{stage: StageRcpt, expect: 25, exit: ExitRcpt, cmd: c.rcptCommand(to)})
+	}
+	if !c.bdat {
+		batch = append(batch, pipelined{stage: StageData, expect: 354, exit: ExitData, cmd: "DATA"})
+	}
+
+	stopAt := StageNone
+	for i, p := range batch {
+		if c.reached(c.config.QuitAfter, p.stage) || c.reached(c.config.DropAfter, p.stage) ||
+			c.reached(c.config.DropAfterSend, p.stage) {
+			batch = batch[:i+1]
+			stopAt = p.stage
+			break
+		}
+	}
+
+	_ = c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	defer func() {
+		_ = c.conn.SetDeadline(time.Time{})
+	}()
+
+	for i := range batch {
+		c.Message(HintSendQ, batch[i].cmd)
+		batch[i].id, err = c.Text.Cmd("%s", batch[i].cmd)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = c.dropAfterSend(stopAt); err != nil {
+		return nil, err
+	}
+
+	c.recvHint = HintRecvQ
+	var firstErr, otherErr error
+	dataAccepted := false
+	for i, p := range batch {
+		c.Text.StartResponse(p.id)
+		code, msg, err := c.ReadResponse(p.expect)
+		c.Text.EndResponse(p.id)
+		if p.stage == StageRcpt {
+			c.recordRcpt(recipients[i-1], code, msg)
+		}
+		if err != nil {
+			var tpErr *textproto.Error
+			if !errors.As(err, &tpErr) {
+				c.recvHint = HintRecv
+				return nil, err
+			}
+			if firstErr == nil {
+				firstErr = failed(p.exit, err)
+			}
+			if p.stage != StageRcpt && otherErr == nil {
+				otherErr = err
+			}
+			continue
+		}
+		switch p.stage {
+		case StageRcpt:
+			c.rcpts = append(c.rcpts, recipients[i-1])
+		case StageData:
+			dataAccepted = true
+		}
+	}
+	c.recvHint = HintRecv
+
+	// With --skip-bad-rcpts we carry on if only some RCPTs failed
+	skip := c.config.SkipBadRcpts && otherErr == nil && len(c.rcpts) > 0
+	if firstErr == nil || skip {
+		if err = c.stopAfter(stopAt); err != nil {
+			return nil, err
+		}
+		if c.bdat {
+			return nil, nil
+		}
+		return &dataCloser{c, c.Text.DotWriter()}, nil
+	}
+	// A rejection is reported the same way whether or not we were
+	// asked to stop here, as it would be without pipelining
+	if dataAccepted {
+		if len(c.rcpts) > 0 {
+			// Sending the terminating dot would deliver an empty message
+			// to those recipients that were accepted
+			c.Message(HintWarn, "Dropping connection to abandon the transaction")
+			_ = c.Text.Close()
+			return nil, firstErr
+		}
+		// With no valid recipients the server will reject the dot,
+		// RFC 2920 section 3.1
+		c.Message(HintSend, ".")
+		if err = c.Text.PrintfLine("."); err != nil {
+			return nil, err
+		}
+		_, _, _ = c.ReadResponse(250)
+	}
+	return nil, firstErr
+}
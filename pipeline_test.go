@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestPipelineTransaction sends MAIL, three RCPTs and DATA as one batch
+// and checks each response is matched with the command it answers
+func TestPipelineTransaction(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		replies  map[string]string
+		want     ExitCode
+		accepted []bool
+		sent     bool
+	}{
+		{
+			name:     "all accepted",
+			want:     ExitOk,
+			accepted: []bool{true, true, true},
+			sent:     true,
+		},
+		{
+			name:     "one rejected",
+			replies:  map[string]string{"RCPT TO:<b@example.com>": "550 5.1.1 no such user"},
+			want:     ExitRcpt,
+			accepted: []bool{true, false, true},
+		},
+		{
+			name:     "one rejected with --skip-bad-rcpts",
+			args:     []string{"--skip-bad-rcpts"},
+			replies:  map[string]string{"RCPT TO:<b@example.com>": "550 5.1.1 no such user"},
+			want:     ExitOk,
+			accepted: []bool{true, false, true},
+			sent:     true,
+		},
+		{
+			name:     "one deferred with --skip-bad-rcpts",
+			args:     []string{"--skip-bad-rcpts"},
+			replies:  map[string]string{"RCPT TO:<rcpt@example.com>": "450 4.2.1 mailbox busy"},
+			want:     ExitOk,
+			accepted: []bool{false, true, true},
+			sent:     true,
+		},
+		{
+			name: "all rejected",
+			replies: map[string]string{
+				"RCPT TO:<rcpt@example.com>": "550 5.1.1 no",
+				"RCPT TO:<b@example.com>":    "550 5.1.1 no",
+				"RCPT TO:<c@example.com>":    "451 4.3.0 later",
+				"DATA":                       "554 5.5.1 no valid recipients",
+			},
+			want:     ExitRcpt,
+			accepted: []bool{false, false, false},
+		},
+		{
+			name: "all rejected with --skip-bad-rcpts",
+			args: []string{"--skip-bad-rcpts"},
+			replies: map[string]string{
+				"RCPT TO:<rcpt@example.com>": "550 5.1.1 no",
+				"RCPT TO:<b@example.com>":    "550 5.1.1 no",
+				"RCPT TO:<c@example.com>":    "550 5.1.1 no",
+				"DATA":                       "554 5.5.1 no valid recipients",
+			},
+			want:     ExitRcpt,
+			accepted: []bool{false, false, false},
+		},
+		{
+			name: "DATA rejected with --skip-bad-rcpts",
+			args: []string{"--skip-bad-rcpts"},
+			replies: map[string]string{
+				"RCPT TO:<b@example.com>": "550 5.1.1 no",
+				"DATA":                    "451 4.3.0 later",
+			},
+			want:     ExitRcpt,
+			accepted: []bool{true, false, true},
+		},
+		{
+			name: "MAIL rejected",
+			replies: map[string]string{
+				"MAIL FROM:<sender@example.com>": "550 5.7.1 go away",
+				"RCPT TO:<rcpt@example.com>":     "503 5.5.1 need MAIL",
+				"RCPT TO:<b@example.com>":        "503 5.5.1 need MAIL",
+				"RCPT TO:<c@example.com>":        "503 5.5.1 need MAIL",
+				"DATA":                           "503 5.5.1 need MAIL",
+			},
+			want:     ExitMail,
+			accepted: []bool{false, false, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := false
+			addr, wait := testSMTPServer(t, []string{"PIPELINING"}, func(cmd string) string {
+				if cmd == "." {
+					sent = true
+				}
+				return tt.replies[cmd]
+			})
+			args := append([]string{"--server", addr, "--timeout", "5s", "--pipeline", "--to", "b@example.com,c@example.com"}, tt.args...)
+			config := testConfig(t, append(args, "--report-json", t.TempDir()+"/report.json")...)
+			payload, err := MakePayload(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testOutput(t, func() {
+				err = send(config, payload)
+			})
+			received := wait()
+
+			if got := exitCode(err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", err, got, tt.want)
+			}
+			if sent != tt.sent {
+				t.Errorf("message sent = %v, want %v", sent, tt.sent)
+			}
+			want := []string{"MAIL FROM:<sender@example.com>", "RCPT TO:<rcpt@example.com>", "RCPT TO:<b@example.com>", "RCPT TO:<c@example.com>", "DATA"}
+			var batch []string
+			for _, line := range received {
+				if strings.HasPrefix(line, "MAIL") || strings.HasPrefix(line, "RCPT") || line == "DATA" {
+					batch = append(batch, line)
+				}
+			}
+			if !reflect.DeepEqual(batch, want) {
+				t.Errorf("sent %q, want %q", batch, want)
+			}
+			var accepted []bool
+			for _, r := range config.report.Recipients {
+				accepted = append(accepted, r.Accepted)
+			}
+			if !reflect.DeepEqual(accepted, tt.accepted) {
+				t.Errorf("recipients accepted = %v, want %v", accepted, tt.accepted)
+			}
+		})
+	}
+}
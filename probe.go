@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// Latency is how long one step of a session took
+type Latency struct {
+	Step         string
+	Milliseconds float64
+}
+
+// latency records how long a step took, from start until now, when
+// we're probing
+func (c *Client) latency(step string, start time.Time) {
+	if !c.config.Probe {
+		return
+	}
+	d := time.Since(start)
+	c.latencies = append(c.latencies, Latency{Step: step, Milliseconds: float64(d.Microseconds()) / 1000})
+}
+
+// ProbeReport describes what a server offers, for --probe
+type ProbeReport struct {
+	Server        string
+	Address       string
+	Banner        string
+	Extensions    []Extension
+	TLS           *ProbeTLS
+	ExtensionsTLS []Extension
+	Latencies     []Latency
+	Error         string
+}
+
+// Extension is an ESMTP extension advertised in response to EHLO
+type Extension struct {
+	Name   string
+	Params string
+}
+
+// ProbeTLS describes a TLS session
+type ProbeTLS struct {
+	Version      string
+	CipherSuite  string
+	ALPN         string
+	Certificates []ProbeCert
+	Verified     bool
+	VerifyError  string
+}
+
+// ProbeCert describes one certificate in the chain the server presented
+type ProbeCert struct {
+	Subject   string
+	Issuer    string
+	SANs      []string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// probeDefaults makes a probe try STARTTLS, and report on an
+// untrusted certificate rather than give up, unless we've been told
+// otherwise
+func (config *Config) probeDefaults(fs *flag.FlagSet) {
+	tlsFlags := []string{"tls", "tls-optional", "tlso", "tls-optional-strict", "tlsos", "tls-on-connect", "tlsc"}
+	changed := false
+	for _, name := range tlsFlags {
+		if fs.Changed(name) {
+			changed = true
+		}
+	}
+	if !changed {
+		config.TLSOptional = true
+	}
+	if !fs.Changed("tls-verify") && !fs.Changed("no-tls-verify") {
+		config.noTLSVerify = true
+	}
+}
+
+// probe connects to a server, says EHLO, and STARTTLS and EHLO again
+// if we can, then leaves without sending mail and reports on what
+// the server offered
+func probe(config Config) error {
+	host, _, err := net.SplitHostPort(config.Server)
+	if err != nil {
+		host = config.Server
+	}
+	report := &ProbeReport{Server: host, Address: config.Server}
+	if config.report != nil {
+		config.report.Probe = report
+	}
+	if config.ReportJSON != "-" {
+		defer config.printProbe(report)
+	}
+
+	config, err = daneForHost(config, "", host, config.Server)
+	if err != nil {
+		report.Error = err.Error()
+		return failed(ExitTLS, err)
+	}
+	start := time.Now()
+	conn, err := Dial(config, config.Server, false)
+	if err != nil {
+		report.Error = err.Error()
+		return failed(ExitConnect, err)
+	}
+	connectLatency := Latency{Step: "connect", Milliseconds: float64(time.Since(start).Microseconds()) / 1000}
+	c, err := NewClient(config, conn, host)
+	if c != nil {
+		c.latencies = append([]Latency{connectLatency}, c.latencies...)
+		defer func() {
+			report.Latencies = c.latencies
+		}()
+		defer c.Close()
+	}
+	if err != nil {
+		report.Error = err.Error()
+		return err
+	}
+	err = c.probe(report)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return err
+}
+
+func (c *Client) probe(report *ProbeReport) error {
+	report.Banner = c.banner
+	if err := c.hello(); err != nil {
+		return failed(ExitHelo, err)
+	}
+	report.Extensions = c.extensions()
+	if c.tls {
+		// --tls-on-connect
+		report.TLS = c.probeTLS()
+		return c.Quit()
+	}
+	err := c.maybeStartTLS()
+	if c.tls {
+		report.TLS = c.probeTLS()
+		if err == nil {
+			report.ExtensionsTLS = c.extensions()
+		}
+	}
+	if err != nil {
+		return failed(ExitTLS, err)
+	}
+	return c.Quit()
+}
+
+// extensions lists what the server advertised in its last EHLO
+func (c *Client) extensions() []Extension {
+	ext := make([]Extension, 0, len(c.ext))
+	for name, params := range c.ext {
+		ext = append(ext, Extension{Name: name, Params: params})
+	}
+	sort.Slice(ext, func(i, j int) bool {
+		return ext[i].Name < ext[j].Name
+	})
+	return ext
+}
+
+func (c *Client) probeTLS() *ProbeTLS {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	report := &ProbeTLS{
+		Version:     tlsVersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ALPN:        state.NegotiatedProtocol,
+	}
+	for _, cert := range state.PeerCertificates {
+		report.Certificates = append(report.Certificates, ProbeCert{
+			Subject:   cert.Subject.String(),
+			Issuer:    cert.Issuer.String(),
+			SANs:      certSANs(cert),
+			NotBefore: cert.NotBefore.UTC(),
+			NotAfter:  cert.NotAfter.UTC(),
+		})
+	}
+	name := c.remoteHost
+	if c.config.TLSSNI != "" {
+		name = c.config.TLSSNI
+	}
+	// The same checks as sending would make, including DANE and pins
+	if err := c.config.tlsVerified(state, c.remoteHost, name); err != nil {
+		report.VerifyError = err.Error()
+	} else {
+		report.Verified = true
+	}
+	return report
+}
+
+// printProbe prints the report of a probe
+func (config Config) printProbe(report *ProbeReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	_, _ = fmt.Fprintf(w, "\nProbe of %s [%s]\n", report.Server, report.Address)
+	if report.Banner != "" {
+		_, _ = fmt.Fprintf(w, "  Banner:\t%s\n", strings.ReplaceAll(report.Banner, "\n", "\n\t"))
+	}
+	printExtensions(w, "Extensions", report.Extensions)
+	if t := report.TLS; t != nil {
+		_, _ = fmt.Fprintf(w, "  TLS:\t%s, %s\n", t.Version, t.CipherSuite)
+		if t.ALPN != "" {
+			_, _ = fmt.Fprintf(w, "    ALPN:\t%s\n", t.ALPN)
+		}
+		for i, cert := range t.Certificates {
+			_, _ = fmt.Fprintf(w, "    Certificate %d:\t%s\n", i, cert.Subject)
+			if len(cert.SANs) > 0 {
+				_, _ = fmt.Fprintf(w, "      SANs:\t%s\n", strings.Join(cert.SANs, ", "))
+			}
+			_, _ = fmt.Fprintf(w, "      Issuer:\t%s\n", cert.Issuer)
+			_, _ = fmt.Fprintf(w, "      Valid:\t%s to %s\n", cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+		}
+		if t.Verified {
+			_, _ = fmt.Fprintf(w, "    Verified:\tyes\n")
+		} else {
+			_, _ = fmt.Fprintf(w, "    Verified:\tno, %s\n", t.VerifyError)
+		}
+	}
+	if report.ExtensionsTLS != nil {
+		printExtensions(w, "Extensions after STARTTLS", report.ExtensionsTLS)
+	}
+	if len(report.Latencies) > 0 {
+		_, _ = fmt.Fprintf(w, "  Latencies:\n")
+		for _, l := range report.Latencies {
+			_, _ = fmt.Fprintf(w, "    %s:\t%.1fms\n", l.Step, l.Milliseconds)
+		}
+	}
+	if report.Error != "" {
+		_, _ = fmt.Fprintf(w, "  Error:\t%s\n", report.Error)
+	}
+}
+
+func printExtensions(w *tabwriter.Writer, title string, ext []Extension) {
+	if len(ext) == 0 {
+		return
+	}
+	_, _ = fmt.Fprintf(w, "  %s:\n", title)
+	for _, e := range ext {
+		params := e.Params
+		if e.Name == "SIZE" && params != "" {
+			var size int64
+			if _, err := fmt.Sscan(params, &size); err == nil && size > 0 {
+				params = fmt.Sprintf("%s (%.1f MiB)", params, float64(size)/(1<<20))
+			}
+		}
+		_, _ = fmt.Fprintf(w, "    %s\t%s\n", e.Name, params)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxiedConn is a connection tunnelled through a proxy. It reports
+// the address at the far end of the tunnel, not the proxy's.
+type proxiedConn struct {
+	net.Conn
+	remote proxyTarget
+}
+
+func (c proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// proxyTarget is the host:port we asked the proxy to connect to,
+// which may be a hostname the proxy resolves for us
+type proxyTarget string
+
+func (a proxyTarget) Network() string {
+	return "tcp"
+}
+
+func (a proxyTarget) String() string {
+	return string(a)
+}
+
+// parseProxy checks a --proxy URL
+func parseProxy(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme '%s', must be socks5 or http", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("no proxy host given")
+	}
+	if u.Port() == "" {
+		if u.Scheme == "http" {
+			u.Host = net.JoinHostPort(u.Host, "8080")
+		} else {
+			u.Host = net.JoinHostPort(u.Host, "1080")
+		}
+	}
+	return u, nil
+}
+
+// dialProxy connects to addr through the --proxy, applying the timeout
+// to both the connection to the proxy and its handshake. network is
+// the family we'd have dialed directly, which the proxy can only be
+// held to by giving it an address rather than a hostname.
+func dialProxy(config Config, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	u := config.proxyURL
+	config.Messagef(HintInfo, "Connecting via %s proxy %s...", proxyKind(u), u.Redacted())
+	addr, err := config.proxyAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if u.Scheme == "http" {
+		conn, err = dialHTTPConnect(config, dialer, u, addr)
+	} else {
+		conn, err = dialSOCKS5(config, dialer, u, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	config.Messagef(HintInfo, "Proxy tunnel to %s established", addr)
+	return proxiedConn{Conn: conn, remote: proxyTarget(addr)}, nil
+}
+
+// proxyAddr resolves the host in addr to an address of the family
+// network asks for, if it asks for one
+func (config Config) proxyAddr(network, addr string) (string, error) {
+	if network == "tcp" {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+	defer cancel()
+	ips, err := config.resolver().LookupIP(ctx, "ip"+strings.TrimPrefix(network, "tcp"), host)
+	if err != nil {
+		return "", err
+	}
+	target := net.JoinHostPort(ips[0].String(), port)
+	if target != addr {
+		family := "IPv4"
+		if network == "tcp6" {
+			family = "IPv6"
+		}
+		config.Messagef(HintInfo, "Asking the proxy for %s, an %s address of %s", target, family, host)
+	}
+	return target, nil
+}
+
+func proxyKind(u *url.URL) string {
+	if u.Scheme == "http" {
+		return "HTTP CONNECT"
+	}
+	return "SOCKS5"
+}
+
+func dialSOCKS5(config Config, dialer *net.Dialer, u *url.URL, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{
+			User:     u.User.Username(),
+			Password: password,
+		}
+	}
+	d, err := proxy.SOCKS5("tcp", u.Host, auth, dialer)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+	defer cancel()
+	return d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+}
+
+func dialHTTPConnect(config Config, dialer *net.Dialer, u *url.URL, addr string) (net.Conn, error) {
+	conn, err := dialer.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(config.Timeout))
+	defer func() {
+		_ = conn.SetDeadline(time.Time{})
+	}()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err = req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+	// The SMTP banner may have arrived along with the proxy's response
+	return bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn reads from a buffer that may hold data already read
+// from the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// parseProxyAddr checks a --proxy-source or --proxy-dest address
+func parseProxyAddr(flag, addr string) (*net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, Fatalf(ExitFlags, "invalid value for %s: %w", flag, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, Fatalf(ExitFlags, "invalid value for %s: '%s' is not an IP address", flag, host)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return nil, Fatalf(ExitFlags, "invalid value for %s: '%s' is not a port", flag, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: p}, nil
+}
+
+// proxyAddrs returns the addresses to claim in a PROXY header,
+// defaulting to those of the real connection
+func (config Config) proxyAddrs(conn net.Conn) (src, dst *net.TCPAddr, err error) {
+	src, dst = config.proxySource, config.proxyDest
+	if src == nil {
+		if src, err = parseProxyAddr("--proxy-source", conn.LocalAddr().String()); err != nil {
+			return nil, nil, fmt.Errorf("can't use local address %s as PROXY source, give --proxy-source", conn.LocalAddr())
+		}
+	}
+	if dst == nil {
+		if dst, err = parseProxyAddr("--proxy-dest", conn.RemoteAddr().String()); err != nil {
+			return nil, nil, fmt.Errorf("can't use remote address %s as PROXY destination, give --proxy-dest", conn.RemoteAddr())
+		}
+	}
+	if (src.IP.To4() == nil) != (dst.IP.To4() == nil) {
+		return nil, nil, fmt.Errorf("PROXY source %s and destination %s must be the same address family", src, dst)
+	}
+	return src, dst, nil
+}
+
+// sendProxyHeader writes a HAProxy PROXY protocol header, which must
+// come before anything else on the connection
+func (config Config) sendProxyHeader(conn net.Conn) error {
+	var header []byte
+	if conn.LocalAddr().Network() == "unix" && config.proxySource == nil {
+		header = config.proxyHeaderUnknown()
+	} else {
+		src, dst, err := config.proxyAddrs(conn)
+		if err != nil {
+			config.Messagef(HintError, "%v", err)
+			return err
+		}
+		if config.proxyProtocol == 1 {
+			header = config.proxyHeaderV1(src, dst)
+		} else {
+			header = config.proxyHeaderV2(src, dst)
+		}
+	}
+	_ = conn.SetDeadline(time.Now().Add(config.Timeout))
+	defer func() {
+		_ = conn.SetDeadline(time.Time{})
+	}()
+	if _, err := conn.Write(header); err != nil {
+		config.Messagef(HintError, "Failed to send PROXY header: %v", err)
+		return err
+	}
+	return nil
+}
+
+// proxyHeaderUnknown is for connections we can't describe
+func (config Config) proxyHeaderUnknown() []byte {
+	config.Message(HintInfo, "Sending PROXY header for an unknown connection")
+	if config.proxyProtocol == 1 {
+		config.Message(HintSend, "PROXY UNKNOWN")
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	header := append([]byte(nil), proxyV2Signature...)
+	// Version 2, LOCAL command, unspecified family, no addresses
+	header = append(header, 0x20, 0x00, 0x00, 0x00)
+	config.Messagef(HintSend, "%s", hex.EncodeToString(header))
+	return header
+}
+
+func (config Config) proxyHeaderV1(src, dst *net.TCPAddr) []byte {
+	family := "TCP4"
+	if src.IP.To4() == nil {
+		family = "TCP6"
+	}
+	line := fmt.Sprintf("PROXY %s %s %s %d %d", family, src.IP, dst.IP, src.Port, dst.Port)
+	config.Messagef(HintInfo, "Sending PROXY v1 header claiming %s -> %s", src, dst)
+	config.Message(HintSend, line)
+	return []byte(line + "\r\n")
+}
+
+func (config Config) proxyHeaderV2(src, dst *net.TCPAddr) []byte {
+	var addrs bytes.Buffer
+	family := byte(0x11) // TCP over IPv4
+	if ip4 := src.IP.To4(); ip4 != nil {
+		addrs.Write(ip4)
+		addrs.Write(dst.IP.To4())
+	} else {
+		family = 0x21 // TCP over IPv6
+		addrs.Write(src.IP.To16())
+		addrs.Write(dst.IP.To16())
+	}
+	_ = binary.Write(&addrs, binary.BigEndian, uint16(src.Port))
+	_ = binary.Write(&addrs, binary.BigEndian, uint16(dst.Port))
+
+	var header bytes.Buffer
+	header.Write(proxyV2Signature)
+	// Version 2, PROXY command
+	header.WriteByte(0x21)
+	header.WriteByte(family)
+	_ = binary.Write(&header, binary.BigEndian, uint16(addrs.Len()))
+	header.Write(addrs.Bytes())
+	config.Messagef(HintInfo, "Sending PROXY v2 header claiming %s -> %s", src, dst)
+	config.Messagef(HintSend, "%s", hex.EncodeToString(header.Bytes()))
+	return header.Bytes()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestProxyHeader(t *testing.T) {
+	v2 := "\r\n\r\n\x00\r\nQUIT\n"
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			name: "v1 IPv4",
+			args: []string{"--proxy-protocol", "v1", "--proxy-source", "192.0.2.1:12345", "--proxy-dest", "198.51.100.2:25"},
+			want: "PROXY TCP4 192.0.2.1 198.51.100.2 12345 25\r\n",
+		},
+		{
+			name: "v1 IPv6",
+			args: []string{"--proxy-protocol", "v1", "--proxy-source", "[2001:db8::1]:12345", "--proxy-dest", "[2001:db8::2]:25"},
+			want: "PROXY TCP6 2001:db8::1 2001:db8::2 12345 25\r\n",
+		},
+		{
+			name: "v2 IPv4",
+			args: []string{"--proxy-protocol", "v2", "--proxy-source", "192.0.2.1:12345", "--proxy-dest", "198.51.100.2:25"},
+			want: v2 + "\x21\x11\x00\x0c" + "\xc0\x00\x02\x01" + "\xc6\x33\x64\x02" + "\x30\x39\x00\x19",
+		},
+		{
+			name: "v2 IPv6",
+			args: []string{"--proxy-protocol", "v2", "--proxy-source", "[2001:db8::1]:12345", "--proxy-dest", "[2001:db8::2]:25"},
+			want: v2 + "\x21\x21\x00\x24" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+				"\x30\x39\x00\x19",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(t, tt.args...)
+			var got []byte
+			if config.proxyProtocol == 1 {
+				got = config.proxyHeaderV1(config.proxySource, config.proxyDest)
+			} else {
+				got = config.proxyHeaderV2(config.proxySource, config.proxyDest)
+			}
+			if string(got) != tt.want {
+				t.Errorf("header = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyHeaderUnknown(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+	}{
+		{"v1", "PROXY UNKNOWN\r\n"},
+		{"v2", "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00"},
+	}
+	for _, tt := range tests {
+		config := testConfig(t, "--proxy-protocol", tt.version)
+		if got := config.proxyHeaderUnknown(); string(got) != tt.want {
+			t.Errorf("%s header = %q, want %q", tt.version, got, tt.want)
+		}
+	}
+}
+
+// TestSendProxyHeader checks the header reaches the server, claiming
+// the real addresses unless told otherwise
+func TestSendProxyHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{name: "real addresses", args: []string{"--proxy-protocol", "v1"}, want: "PROXY TCP4 127.0.0.1 127.0.0.1 "},
+		{name: "claimed source", args: []string{"--proxy-protocol", "v1", "--proxy-source", "192.0.2.1:12345"}, want: "PROXY TCP4 192.0.2.1 127.0.0.1 12345 "},
+		{name: "mixed families", args: []string{"--proxy-protocol", "v1", "--proxy-source", "[2001:db8::1]:12345"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			received := make(chan string, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					received <- ""
+					return
+				}
+				defer conn.Close()
+				b, _ := io.ReadAll(conn)
+				received <- string(b)
+			}()
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := testConfig(t, tt.args...)
+			testOutput(t, func() {
+				err = config.sendProxyHeader(conn)
+			})
+			_ = conn.Close()
+			got := <-received
+			if tt.wantErr {
+				if err == nil || got != "" {
+					t.Errorf("sendProxyHeader() sent %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sendProxyHeader: %v", err)
+			}
+			if !strings.HasPrefix(got, tt.want) || !strings.HasSuffix(got, " "+strings.TrimPrefix(l.Addr().String(), "127.0.0.1:")+"\r\n") {
+				t.Errorf("sendProxyHeader() sent %q, want %q... ending with the server port", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseProxyAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{"192.0.2.1:25", "192.0.2.1:25", false},
+		{"[2001:db8::1]:587", "[2001:db8::1]:587", false},
+		{"192.0.2.1", "", true},
+		{"mail.example.com:25", "", true},
+		{"192.0.2.1:smtp", "", true},
+		{"192.0.2.1:65536", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseProxyAddr("--proxy-source", tt.addr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseProxyAddr(%q) error = %v, want error %v", tt.addr, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("parseProxyAddr(%q) = %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// RcptResult is the server's response to a single RCPT
+type RcptResult struct {
+	Address      string
+	Host         string // the server that responded
+	Server       string // and the address we connected to
+	Code         int
+	EnhancedCode string
+	Text         string
+	Accepted     bool
+}
+
+// Report is the machine-readable record of a run, for --report-json
+type Report struct {
+	Recipients []RcptResult
+	Deliveries []RcptResult `json:",omitempty"` // LMTP responses after the final dot
+	Probe      *ProbeReport `json:",omitempty"`
+}
+
+// rcptResult describes the response to a RCPT, or for LMTP to the
+// final dot, for one recipient
+func (c *Client) rcptResult(to string, code int, msg string) RcptResult {
+	// Multiline responses repeat the enhanced code on each line
+	lines := strings.Split(msg, "\n")
+	enhanced, text := c.splitEnhancedCode(lines[0])
+	for _, line := range lines[1:] {
+		_, more := c.splitEnhancedCode(line)
+		text += " " + more
+	}
+	return RcptResult{
+		Address:      to,
+		Host:         c.remoteHost,
+		Server:       c.conn.RemoteAddr().String(),
+		Code:         code,
+		EnhancedCode: enhanced,
+		Text:         text,
+		Accepted:     code/100 == 2,
+	}
+}
+
+// rcptHint picks the colour to show a response to a recipient in
+func rcptHint(code int) Hint {
+	switch code / 100 {
+	case 4:
+		return HintDefer
+	case 5:
+		return HintReject
+	}
+	return HintAccept
+}
+
+// recordRcpt notes the response to a RCPT, for the summary and report
+func (c *Client) recordRcpt(to string, code int, msg string) {
+	if code == 0 {
+		// We didn't get a response
+		return
+	}
+	result := c.rcptResult(to, code, msg)
+	c.rcptResults = append(c.rcptResults, result)
+	if c.config.report != nil {
+		c.config.report.Recipients = append(c.config.report.Recipients, result)
+	}
+}
+
+// reportRcpts prints a table of how the server responded to each
+// recipient, if there was more than one
+func (c *Client) reportRcpts() {
+	if len(c.rcptResults) < 2 {
+		return
+	}
+	width := len("Recipient")
+	for _, r := range c.rcptResults {
+		if len(r.Address) > width {
+			width = len(r.Address)
+		}
+	}
+	accepted := 0
+	for _, r := range c.rcptResults {
+		if r.Accepted {
+			accepted++
+		}
+	}
+	c.Messagef(HintInfo, "%d of %d recipients accepted by %s:", accepted, len(c.rcptResults), c.remoteHost)
+	c.Messagef(HintInfo, "  %-*s  Code  Enhanced  Text", width, "Recipient")
+	for _, r := range c.rcptResults {
+		enhanced := r.EnhancedCode
+		if enhanced == "" {
+			enhanced = "-"
+		}
+		c.Messagef(rcptHint(r.Code), "  %-*s  %-4d  %-8s  %s", width, r.Address, r.Code, enhanced, r.Text)
+	}
+}
+
+// writeReport writes the --report-json file, or to stdout for "-"
+func (config Config) writeReport() error {
+	if config.report == nil {
+		return nil
+	}
+	out := os.Stdout
+	if config.ReportJSON != "-" {
+		f, err := os.Create(config.ReportJSON)
+		if err != nil {
+			return Fatalf(ExitOther, "while writing --report-json: %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(config.report); err != nil {
+		return Fatalf(ExitOther, "while writing --report-json: %w", err)
+	}
+	return nil
+}
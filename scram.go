@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// scramAuth is RFC 5802 SCRAM, with RFC 7677 SHA-256 and, for the
+// -PLUS variants, channel binding to the TLS session. We don't
+// SASLprep the username or password.
+type scramAuth struct {
+	config   Config
+	mech     string
+	hash     func() hash.Hash
+	plus     bool
+	username string
+	password string
+
+	gs2Header       string
+	cbData          []byte
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+	verified        bool
+	step            int
+}
+
+func newSCRAM(config Config, mech string) *scramAuth {
+	a := &scramAuth{
+		config:   config,
+		mech:     mech,
+		hash:     sha1.New,
+		plus:     strings.HasSuffix(mech, "-PLUS"),
+		username: config.AuthUser,
+		password: config.AuthPassword,
+	}
+	if strings.HasPrefix(mech, "SCRAM-SHA-256") {
+		a.hash = sha256.New
+	}
+	return a
+}
+
+func (a *scramAuth) Start(server *ServerInfo) (string, []byte, string, error) {
+	switch {
+	case a.plus:
+		if server.TLSState == nil {
+			return a.mech, nil, "", errors.New("channel binding needs a TLS session")
+		}
+		cbType, cbData, err := channelBinding(server.TLSState)
+		if err != nil {
+			return a.mech, nil, "", err
+		}
+		a.config.Messagef(HintInfo, "  %s: channel binding with %s", a.mech, cbType)
+		a.gs2Header = "p=" + cbType + ",,"
+		a.cbData = cbData
+	case server.TLS && !server.offers(a.mech+"-PLUS"):
+		// We could do channel binding, but the server can't
+		a.gs2Header = "y,,"
+	default:
+		a.gs2Header = "n,,"
+	}
+
+	nonce := make([]byte, 24)
+	if _, err := rand.Read(nonce); err != nil {
+		return a.mech, nil, "", err
+	}
+	a.clientNonce = base64.RawStdEncoding.EncodeToString(nonce)
+	a.clientFirstBare = "n=" + scramName(a.username) + ",r=" + a.clientNonce
+	resp := a.gs2Header + a.clientFirstBare
+	return a.mech, []byte(resp), resp, nil
+}
+
+func (a *scramAuth) Next(fromServer []byte, more bool) ([]byte, string, error) {
+	a.step++
+	switch {
+	case a.step == 1 && more:
+		resp, shown, err := a.clientFinal(string(fromServer))
+		if err != nil {
+			return nil, "", err
+		}
+		return []byte(resp), shown, nil
+	case a.step == 2 && more:
+		if err := a.checkServerFinal(string(fromServer)); err != nil {
+			return nil, "", err
+		}
+		return []byte{}, "", nil
+	case more:
+		return nil, "", errors.New("unexpected server challenge")
+	}
+	if !a.verified {
+		return nil, "", errors.New("server accepted us without proving it knows the password")
+	}
+	return nil, "", nil
+}
+
+// clientFinal builds client-final-message from server-first-message,
+// and how to show it
+func (a *scramAuth) clientFinal(serverFirst string) (string, string, error) {
+	attrs := scramAttrs(serverFirst)
+	if e, ok := attrs["e"]; ok {
+		return "", "", fmt.Errorf("server reported %s", e)
+	}
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, a.clientNonce) || len(nonce) == len(a.clientNonce) {
+		return "", "", errors.New("server nonce doesn't extend ours")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil || len(salt) == 0 {
+		return "", "", fmt.Errorf("invalid salt '%s'", attrs["s"])
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations < 1 {
+		return "", "", fmt.Errorf("invalid iteration count '%s'", attrs["i"])
+	}
+	a.config.Messagef(HintInfo, "  %s: salt %s, %d iterations", a.mech, attrs["s"], iterations)
+	if iterations < 4096 {
+		a.config.Messagef(HintWarn, "  %s: iteration count %d is below the recommended 4096", a.mech, iterations)
+	}
+
+	cb := base64.StdEncoding.EncodeToString(append([]byte(a.gs2Header), a.cbData...))
+	withoutProof := "c=" + cb + ",r=" + nonce
+	authMessage := []byte(a.clientFirstBare + "," + serverFirst + "," + withoutProof)
+
+	saltedPassword := scramHi(a.hash, []byte(a.password), salt, iterations)
+	clientKey := a.hmac(saltedPassword, []byte("Client Key"))
+	h := a.hash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+	proof := a.hmac(storedKey, authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	a.serverSignature = a.hmac(a.hmac(saltedPassword, []byte("Server Key")), authMessage)
+	resp := withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+	// The proof, with the salt and iteration count, is enough for an
+	// offline dictionary attack on the password
+	return resp, withoutProof + ",p=" + redacted, nil
+}
+
+// checkServerFinal verifies the server's signature, which proves it
+// knows our password too
+func (a *scramAuth) checkServerFinal(serverFinal string) error {
+	attrs := scramAttrs(serverFinal)
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("server reported %s", e)
+	}
+	v, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || !hmac.Equal(v, a.serverSignature) {
+		return errors.New("server signature does not match")
+	}
+	a.config.Messagef(HintInfo, "  %s: server signature verified", a.mech)
+	a.verified = true
+	return nil
+}
+
+func (a *scramAuth) hmac(key, data []byte) []byte {
+	mac := hmac.New(a.hash, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// scramHi is PBKDF2 with HMAC as the PRF, RFC 5802 section 2.2
+func scramHi(h func() hash.Hash, password, salt []byte, iterations int) []byte {
+	mac := hmac.New(h, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	out := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
+
+// scramAttrs splits a SCRAM message into its attributes
+func scramAttrs(msg string) map[string]string {
+	attrs := map[string]string{}
+	for _, field := range strings.Split(msg, ",") {
+		if len(field) >= 2 && field[1] == '=' {
+			attrs[field[:1]] = field[2:]
+		}
+	}
+	return attrs
+}
+
+// scramName escapes a username, RFC 5802 section 5.1
+func scramName(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+// channelBinding returns the channel binding for a TLS session:
+// tls-unique before TLS 1.3, which doesn't have it, and tls-exporter
+// (RFC 9266) after
+func channelBinding(state *tls.ConnectionState) (string, []byte, error) {
+	if state.Version >= tls.VersionTLS13 {
+		data, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		if err != nil {
+			return "", nil, fmt.Errorf("tls-exporter: %w", err)
+		}
+		return "tls-exporter", data, nil
+	}
+	if len(state.TLSUnique) == 0 {
+		return "", nil, errors.New("no tls-unique channel binding for this session")
+	}
+	return "tls-unique", state.TLSUnique, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestSCRAM runs the example exchanges from RFC 5802 section 5 and
+// RFC 7677 section 3, with the client nonce they use
+func TestSCRAM(t *testing.T) {
+	tests := []struct {
+		mech        string
+		nonce       string
+		serverFirst string
+		clientFinal string
+		serverFinal string
+	}{
+		{
+			mech:        "SCRAM-SHA-1",
+			nonce:       "fyko+d2lbbFgONRv9qkxdawL",
+			serverFirst: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+			clientFinal: "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+			serverFinal: "v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+		},
+		{
+			mech:        "SCRAM-SHA-256",
+			nonce:       "rOprNGfwEbeRWgbNEkqO",
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mech, func(t *testing.T) {
+			a := newSCRAM(testConfig(t, "--auth-user", "user", "--auth-password", "pencil"), tt.mech)
+			a.gs2Header = "n,,"
+			a.clientNonce = tt.nonce
+			a.clientFirstBare = "n=user,r=" + tt.nonce
+			a.step = 1
+
+			resp, shown, err := a.clientFinal(tt.serverFirst)
+			if err != nil {
+				t.Fatalf("clientFinal: %v", err)
+			}
+			if resp != tt.clientFinal {
+				t.Errorf("clientFinal() = %q, want %q", resp, tt.clientFinal)
+			}
+			proof := tt.clientFinal[strings.Index(tt.clientFinal, ",p=")+3:]
+			if strings.Contains(shown, proof) || !strings.HasSuffix(shown, ",p="+redacted) {
+				t.Errorf("clientFinal() shows %q, want the proof redacted", shown)
+			}
+
+			if _, _, err = a.Next([]byte(tt.serverFinal), true); err != nil {
+				t.Errorf("server signature: %v", err)
+			}
+			if _, _, err = a.Next(nil, false); err != nil {
+				t.Errorf("after success: %v", err)
+			}
+		})
+	}
+}
+
+func TestSCRAMServerErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		serverFirst string
+		wantErr     string
+	}{
+		{"error", "e=unknown-user", "server reported unknown-user"},
+		{"nonce not ours", "r=somethingelse,s=QSXCR+Q6sek8bf92,i=4096", "doesn't extend ours"},
+		{"nonce not extended", "r=fyko+d2lbbFgONRv9qkxdawL,s=QSXCR+Q6sek8bf92,i=4096", "doesn't extend ours"},
+		{"bad salt", "r=fyko+d2lbbFgONRv9qkxdawLxyz,s=!!,i=4096", "invalid salt"},
+		{"bad iterations", "r=fyko+d2lbbFgONRv9qkxdawLxyz,s=QSXCR+Q6sek8bf92,i=0", "invalid iteration count"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newSCRAM(testConfig(t, "--auth-user", "user", "--auth-password", "pencil"), "SCRAM-SHA-1")
+			a.gs2Header = "n,,"
+			a.clientNonce = "fyko+d2lbbFgONRv9qkxdawL"
+			a.clientFirstBare = "n=user,r=" + a.clientNonce
+			_, _, err := a.clientFinal(tt.serverFirst)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("clientFinal() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	a := newSCRAM(testConfig(t, "--auth-user", "user", "--auth-password", "pencil"), "SCRAM-SHA-1")
+	a.serverSignature = []byte("not this")
+	if err := a.checkServerFinal("v=rmF9pqV8S7suAoZWja4dJRkFsKQ="); err == nil {
+		t.Error("checkServerFinal accepted the wrong signature")
+	}
+}
+
+func TestSCRAMName(t *testing.T) {
+	if got, want := scramName("a=b,c"), "a=3Db=2Cc"; got != want {
+		t.Errorf("scramName() = %q, want %q", got, want)
+	}
+}
@@ -2,16 +2,46 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"net/textproto"
 	"sort"
 	"strings"
 )
 
-func send(config Config, payload string) error {
-	res := net.Resolver{
-		PreferGo: true,
+// deliveryAttempt records what happened when we tried to deliver
+// to a single address of a single MX
+type deliveryAttempt struct {
+	Host string // the MX hostname
+	Addr string // the host:port we dialed
+	Err  error
+}
+
+func (a deliveryAttempt) outcome() string {
+	if a.Err == nil {
+		return "accepted"
 	}
+	var tpErr *textproto.Error
+	if errors.As(a.Err, &tpErr) {
+		if tpErr.Code/100 == 4 {
+			return fmt.Sprintf("deferred: %d %s", tpErr.Code, firstLine(tpErr.Msg))
+		}
+		return fmt.Sprintf("rejected: %d %s", tpErr.Code, firstLine(tpErr.Msg))
+	}
+	return fmt.Sprintf("failed: %v", a.Err)
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i != -1 {
+		return s[:i]
+	}
+	return s
+}
+
+func send(config Config, payload string) error {
+	res := config.resolver()
 	ctx := context.Background()
 	if config.Size == -1 {
 		config.Size = len(payload)
@@ -19,7 +49,11 @@ func send(config Config, payload string) error {
 
 	// If the user has given us a server
 	if config.Server != "" {
-		err, _ := sendToHost(config, config.To, config.Server, false, payload)
+		host, _, err := net.SplitHostPort(config.Server)
+		if err != nil {
+			host = config.Server
+		}
+		err, _ = sendToHost(config, config.To, "", host, config.Server, false, payload)
 		return err
 	}
 
@@ -33,68 +67,305 @@ func send(config Config, payload string) error {
 		domains[domain] = append(domains[domain], email)
 	}
 
+	var firstErr error
 	for dom, emails := range domains {
 		if len(domains) > 1 {
 			config.Messagef(HintInfo, "Delivering to %s...", dom)
 		}
-		mxes, err := res.LookupMX(ctx, dom)
-		if err != nil {
-			config.Messagef(HintWarn, "While resolving MX for %s: %v", dom, err)
-		}
-		if len(mxes) == 0 {
-			_, _ = sendToHost(
-				config,
-				emails,
-				net.JoinHostPort(dom, "25"),
-				true, payload)
-			continue
+		err := sendToDomain(ctx, res, config, dom, emails, payload)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// sendToDomain delivers to the MXes for a domain the way an MTA would,
+// trying each MX in preference order and each address of each MX in
+// turn, moving on after a connection failure or temporary rejection.
+func sendToDomain(ctx context.Context, res *net.Resolver, config Config, dom string, emails []string, payload string) error {
+	mxes, err := res.LookupMX(ctx, dom)
+	if err != nil && len(mxes) == 0 {
+		// Only a domain with no MX records has an implicit MX
+		// (RFC 5321 section 5.1), anything else means try later
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			config.Messagef(HintError, "While resolving MX for %s: %v", dom, err)
+			return failed(ExitConnect, fmt.Errorf("can't find MX for %s, delivery deferred: %w", dom, err))
 		}
+	} else if err != nil {
+		config.Messagef(HintWarn, "While resolving MX for %s: %v", dom, err)
+	}
+
+	implicit := len(mxes) == 0
+	if implicit {
+		mxes = []*net.MX{{Host: dom}}
+	} else {
 		sort.SliceStable(mxes, func(i, j int) bool {
 			return mxes[i].Pref < mxes[j].Pref
 		})
+		if len(mxes) == 1 && mxes[0].Host == "." {
+			config.Messagef(HintError, "%s has a null MX and does not accept mail", dom)
+			return fmt.Errorf("%s does not accept mail (null MX)", dom)
+		}
+		for _, mx := range mxes {
+			config.Messagef(HintInfo, "MX %d %s", mx.Pref, mx.Host)
+		}
 	}
 
-	return nil
+	var policy *stsPolicy
+	if config.MTASTS {
+		policy = config.fetchSTSPolicy(ctx, res, dom)
+	}
+
+	var attempts []deliveryAttempt
+	var lastErr error
+	accepted := false
+
+mxLoop:
+	for _, mx := range mxes {
+		host := strings.TrimSuffix(mx.Host, ".")
+		hostConfig, ok := policy.apply(config, host)
+		if !ok {
+			err = fmt.Errorf("%s is not permitted by the MTA-STS policy for %s", host, dom)
+			attempts = append(attempts, deliveryAttempt{Host: host, Err: err})
+			lastErr = err
+			continue
+		}
+		ips, err := res.LookupIPAddr(ctx, host)
+		if err != nil {
+			config.Messagef(HintWarn, "While resolving %s: %v", host, err)
+			attempts = append(attempts, deliveryAttempt{Host: host, Err: err})
+			lastErr = err
+			continue
+		}
+		ips = filterAddrs(config, ips, implicit)
+		if len(ips) == 0 {
+			err = fmt.Errorf("no usable addresses for %s", host)
+			config.Messagef(HintWarn, "%v", err)
+			attempts = append(attempts, deliveryAttempt{Host: host, Err: err})
+			lastErr = err
+			continue
+		}
+		for _, ip := range ips {
+			addr := net.JoinHostPort(ip.String(), config.Port)
+			err, _ = sendToHost(hostConfig, emails, dom, host, addr, implicit, payload)
+			attempts = append(attempts, deliveryAttempt{Host: host, Addr: addr, Err: err})
+			lastErr = err
+			if err == nil {
+				accepted = true
+				break mxLoop
+			}
+			if !tryNextHost(err) {
+				break mxLoop
+			}
+		}
+	}
+
+	var exitErr ExitError
+	if errors.As(lastErr, &exitErr) {
+		// We stopped where we were asked to, which isn't the
+		// message being refused, so there's nothing to report
+		return lastErr
+	}
+	reportAttempts(config, dom, attempts, accepted)
+	if accepted {
+		return nil
+	}
+	return lastErr
+}
+
+// filterAddrs removes any addresses we've been asked not to use, or
+// that we can't reach from our local address
+func filterAddrs(config Config, ips []net.IPAddr, v4only bool) []net.IPAddr {
+	localV4, localV6 := config.localFamilies()
+	var ret []net.IPAddr
+	for _, ip := range ips {
+		isV4 := ip.IP.To4() != nil
+		switch {
+		case isV4 && !localV4, !isV4 && !localV6:
+			continue
+		case (config.V4 || v4only) && !isV4:
+			continue
+		case config.V6 && isV4:
+			continue
+		}
+		ret = append(ret, ip)
+	}
+	return ret
+}
+
+// tryNextHost reports whether, after a failed delivery attempt, an MTA
+// would go on to try the next address or MX
+func tryNextHost(err error) bool {
+	var exitErr ExitError
+	if errors.As(err, &exitErr) {
+		// We were asked to quit or drop the connection
+		return false
+	}
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code/100 == 4
+	}
+	// Connection failures, timeouts and the like
+	return true
+}
+
+func reportAttempts(config Config, dom string, attempts []deliveryAttempt, accepted bool) {
+	if len(attempts) == 0 {
+		config.Messagef(HintError, "No hosts to deliver to for %s", dom)
+		return
+	}
+	if accepted {
+		last := attempts[len(attempts)-1]
+		config.Messagef(HintInfo, "Message for %s accepted by %s [%s]", dom, last.Host, last.Addr)
+	} else {
+		config.Messagef(HintError, "Message for %s was not accepted by any MX", dom)
+	}
+	if len(attempts) == 1 {
+		return
+	}
+	for _, a := range attempts {
+		addr := a.Addr
+		if addr == "" {
+			addr = "-"
+		}
+		config.Messagef(HintInfo, "  %s [%s]: %s", a.Host, addr, a.outcome())
+	}
 }
 
 // Attempt to connect to a hostname:port and deliver a
-// message. Returns error and true if it managed to dial,
+// message. domain is the recipient domain we found host as an MX
+// for, if we did. Returns error and true if it managed to dial,
 // false otherwise.
-func sendToHost(config Config, recipients []string, addr string, v4only bool, payload string) (error, bool) {
+func sendToHost(config Config, recipients []string, domain, host, addr string, v4only bool, payload string) (error, bool) {
+	config, err := daneForHost(config, domain, host, addr)
+	if err != nil {
+		return failed(ExitTLS, err), false
+	}
 	conn, err := Dial(config, addr, v4only)
 	if err != nil {
-		return err, false
+		var proxyErr ProxyHeaderError
+		if errors.As(err, &proxyErr) {
+			return failed(ExitProxy, err), false
+		}
+		return failed(ExitConnect, err), false
 	}
-	client, err := NewClient(config, conn, addr)
+	client, err := NewClient(config, conn, host)
 	if err != nil {
+		if client != nil {
+			_ = client.Close()
+		}
 		return err, true
 	}
 	err = sendTo(config, recipients, client, payload)
+	var tlsErr TLSError
+	if errors.As(err, &tlsErr) && config.TLSOptional {
+		// The connection is unusable after a failed handshake, so
+		// do what an opportunistic MTA would and try again in clear
+		config.Messagef(HintWarn, "Retrying %s without TLS", addr)
+		config.UseStartTLS = false
+		return sendToHost(config, recipients, domain, host, addr, v4only, payload)
+	}
 	return err, true
 }
 
+// transaction sends MAIL, RCPT and DATA, pipelined if we can
+func (c *Client) transaction(from string, recipients []string) (io.WriteCloser, error) {
+	if c.config.Pipeline {
+		if _, ok := c.ext["PIPELINING"]; ok {
+			return c.pipelineTransaction(from, recipients)
+		}
+		c.Message(HintWarn, "Server doesn't advertise PIPELINING, sending commands one at a time")
+	}
+	err := c.Mail(from)
+	if err != nil {
+		return nil, failed(ExitMail, err)
+	}
+	var rcptErr error
+	for _, addr := range recipients {
+		err = c.Rcpt(addr)
+		if err == nil {
+			continue
+		}
+		var tpErr *textproto.Error
+		if !c.config.SkipBadRcpts || !errors.As(err, &tpErr) {
+			if len(c.rcpts) > 0 && errors.As(err, &tpErr) {
+				c.Messagef(HintError, "%s was rejected, so the recipients already accepted won't get the message either (see --skip-bad-rcpts)", addr)
+			}
+			return nil, failed(ExitRcpt, err)
+		}
+		if rcptErr == nil {
+			rcptErr = err
+		}
+	}
+	if len(c.rcpts) == 0 {
+		// Every recipient was rejected
+		return nil, failed(ExitRcpt, rcptErr)
+	}
+	if c.bdat {
+		return nil, nil
+	}
+	w, err := c.Data()
+	return w, failed(ExitData, err)
+}
+
 func sendTo(config Config, recipients []string, c *Client, payload string) error {
 	defer c.Close()
+	defer c.reportRcpts()
 
 	if err := c.hello(); err != nil {
-		return err
+		return failed(ExitHelo, err)
+	}
+	if err := c.maybeXclient(); err != nil {
+		return failed(ExitXclient, err)
+	}
+	if err := c.maybeStartTLS(); err != nil {
+		return failed(ExitTLS, err)
+	}
+	if err := c.maybeAuth(); err != nil {
+		return failed(ExitAuth, err)
+	}
+	if err := c.maybeXforward(); err != nil {
+		return failed(ExitXclient, err)
 	}
 
-	err := c.Mail(config.From)
+	c.bdat = c.useBDAT()
+	c.binary = isBinary(payload)
+	w, err := c.transaction(config.From, recipients)
 	if err != nil {
 		return err
 	}
-	for _, addr := range recipients {
-		if err = c.Rcpt(addr); err != nil {
-			return err
+
+	if c.bdat {
+		err = c.sendBDAT(payload)
+	} else {
+		err = c.sendData(w, payload)
+	}
+	var tpErr *textproto.Error
+	if c.lmtp() && errors.As(err, &tpErr) {
+		// Every recipient was refused, but the session is still
+		// good so leave politely
+		if quitErr := c.Quit(); quitErr != nil {
+			c.Messagef(HintWarn, "QUIT failed: %v", quitErr)
 		}
 	}
-	w, err := c.Data()
 	if err != nil {
-		return err
+		return failed(ExitDot, err)
 	}
+	// The message has been accepted, so a failure here mustn't
+	// cause us to try delivering it again somewhere else
+	if err = c.Quit(); err != nil {
+		c.Messagef(HintWarn, "QUIT failed after message was accepted: %v", err)
+	}
+	return nil
+}
 
-	if config.SuppressData {
+// sendData sends the message after a DATA command has been accepted
+func (c *Client) sendData(w io.WriteCloser, payload string) error {
+	var err error
+	if c.config.SuppressData {
 		_, err = io.Copy(w, strings.NewReader(payload))
 		if err != nil {
 			return err
@@ -119,10 +390,5 @@ func sendTo(config Config, recipients []string, c *Client, payload string) error
 	if c.config.DropAfterSend == StageDot {
 		return c.drop()
 	}
-	err = c.Quit()
-	if err != nil {
-		_ = c.Close()
-		return err
-	}
 	return nil
 }
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tlsConfig builds the TLS configuration for a connection to host.
+// We do our own certificate verification after the handshake, so
+// that we can report on certificates we don't trust.
+func (config Config) tlsConfig(host string) *tls.Config {
+	if config.TLSSNI != "" {
+		host = config.TLSSNI
+	}
+	return &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: true, //nolint:gosec
+	}
+}
+
+// handshake starts a TLS session over conn to host, giving up after
+// the configured timeout
+func handshake(config Config, conn net.Conn, tlsConfig *tls.Config, host string) (*tls.Conn, error) {
+	var certReq clientCertRequest
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.GetClientCertificate = config.clientCertificate(&certReq)
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	_ = tlsConn.SetDeadline(time.Now().Add(config.Timeout))
+	err := tlsConn.Handshake()
+	_ = tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		config.Messagef(HintError, "TLS handshake failed: %v", err)
+		config.reportClientCert(certReq)
+		return nil, TLSError{err: err}
+	}
+	state := tlsConn.ConnectionState()
+	config.reportTLS(state, host, tlsConfig.ServerName)
+	config.reportClientCert(certReq)
+	if err = config.verifyTLS(state, host, tlsConfig.ServerName); err != nil {
+		return nil, TLSError{err: err}
+	}
+	return tlsConn, nil
+}
+
+// dialTLS starts a TLS session immediately after connecting, for
+// SMTPS (--tls-on-connect)
+func dialTLS(config Config, conn net.Conn, host string) (net.Conn, error) {
+	tlsConn, err := handshake(config, conn, config.tlsConfig(host), host)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// maybeStartTLS negotiates STARTTLS, if we've been asked to, applying
+// the --tls, --tls-optional or --tls-optional-strict policy
+func (c *Client) maybeStartTLS() error {
+	if !c.config.UseStartTLS || c.tls {
+		return nil
+	}
+	optional := c.config.TLSOptional || c.config.TLSOptionalStrict
+	if _, ok := c.ext["STARTTLS"]; !ok {
+		if !optional {
+			c.Message(HintError, "STARTTLS is required but the server didn't offer it")
+			return BailedError("STARTTLS not offered")
+		}
+		c.Message(HintWarn, "STARTTLS not offered, continuing without TLS")
+		// The EHLO we've already sent is the final one
+		return c.stopAfter(StageHelo)
+	}
+
+	err := c.StartTLS(c.config.tlsConfig(c.remoteHost))
+	if err == nil {
+		return nil
+	}
+	var tpErr *textproto.Error
+	if c.config.TLSOptional && !c.tls && errors.As(err, &tpErr) {
+		c.Message(HintWarn, "STARTTLS rejected, continuing without TLS")
+		return c.stopAfter(StageHelo)
+	}
+	return err
+}
+
+// reportTLS describes a newly established TLS session, and whether
+// the certificate presented is valid for the host we meant to reach
+// and for the name we sent in SNI
+func (config Config) reportTLS(state tls.ConnectionState, host, sni string) {
+	config.Messagef(HintInfo, "TLS started: %s, %s", tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	if net.ParseIP(sni) != nil {
+		// crypto/tls doesn't send an IP address in SNI
+		sni = ""
+	}
+	if sni == "" {
+		config.Message(HintInfo, "  SNI: none")
+	} else {
+		config.Messagef(HintInfo, "  SNI: %s", sni)
+	}
+	alpn := state.NegotiatedProtocol
+	if alpn == "" {
+		alpn = "none"
+	}
+	config.Messagef(HintInfo, "  ALPN: %s", alpn)
+	if state.DidResume {
+		config.Message(HintInfo, "  Session resumed: yes")
+	} else {
+		config.Message(HintInfo, "  Session resumed: no")
+	}
+	if len(state.PeerCertificates) == 0 {
+		config.Message(HintWarn, "  No certificate presented")
+		return
+	}
+	for i, cert := range state.PeerCertificates {
+		config.Messagef(HintInfo, "  Certificate %d:", i)
+		config.Messagef(HintInfo, "    Subject: %s", cert.Subject)
+		if sans := certSANs(cert); len(sans) > 0 {
+			config.Messagef(HintInfo, "    SANs: %s", strings.Join(sans, ", "))
+		}
+		config.Messagef(HintInfo, "    Issuer: %s", cert.Issuer)
+		config.Messagef(HintInfo, "    Valid: %s to %s",
+			cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339))
+		config.Messagef(HintInfo, "    SHA-256: %s", fingerprint(cert.Raw))
+		config.Messagef(HintInfo, "    SPKI SHA-256: %s", spkiHash(cert))
+	}
+	names := []string{host}
+	if sni != "" && sni != host {
+		names = append(names, sni)
+	}
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if err := state.PeerCertificates[0].VerifyHostname(name); err != nil {
+			config.Messagef(HintWarn, "  Certificate name does not match %s", name)
+		} else {
+			config.Messagef(HintInfo, "  Certificate name matches %s", name)
+		}
+	}
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionSSL30:
+		return "SSLv3"
+	case tls.VersionTLS10:
+		return "TLSv1.0"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return fmt.Sprintf("TLS 0x%04x", version)
+}
+
+// certSANs lists the subject alternative names of a certificate
+func certSANs(cert *x509.Certificate) []string {
+	var sans []string
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS:"+name)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, "URI:"+uri.String())
+	}
+	return sans
+}
+
+// fingerprint formats the SHA-256 of data the way openssl does
+func fingerprint(data []byte) string {
+	sum := sha256.Sum256(data)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+// spkiHash is the base64 SHA-256 of a certificate's public key, as
+// used for --tls-pin-spki
+func spkiHash(cert *x509.Certificate) string {
+	return base64.StdEncoding.EncodeToString(spkiDigest(cert))
+}
+
+// verifyTLS checks the certificate chain the server presented against
+// our trust store and any pinned keys. Problems are always reported,
+// but an untrusted chain is only fatal if --tls-verify is in effect.
+// DANE is checked against host, the MX the TLSA records belong to,
+// and everything else against name, which may be --tls-sni.
+func (config Config) verifyTLS(state tls.ConnectionState, host, name string) error {
+	if config.dane.usable() {
+		if err := config.verifyDANE(config.dane, state, host); err != nil {
+			return err
+		}
+		// DANE replaces the usual PKIX checks, RFC 7672 section 3.1
+		config.TLSVerify = false
+	}
+
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		if config.TLSVerify || len(config.tlsPins) > 0 {
+			config.Message(HintError, "Certificate verification failed: no certificate presented")
+			return errors.New("no certificate presented")
+		}
+		return nil
+	}
+
+	var failure error
+	err := config.verifyChain(certs, name)
+	switch {
+	case err == nil:
+		config.Message(HintInfo, "Certificate verified")
+	case config.TLSVerify:
+		failure = errors.New(describeVerifyError(err))
+		config.Messagef(HintError, "Certificate verification failed: %v", failure)
+	default:
+		config.Messagef(HintWarn, "Certificate not verified: %s", describeVerifyError(err))
+	}
+
+	if len(config.tlsPins) > 0 {
+		pinned := false
+		for i, cert := range certs {
+			if _, ok := config.tlsPins[string(spkiDigest(cert))]; ok {
+				config.Messagef(HintInfo, "Certificate %d matches pinned key %s", i, spkiHash(cert))
+				pinned = true
+			}
+		}
+		if !pinned {
+			config.Message(HintError, "Certificate verification failed: no certificate in the chain matches a pinned key")
+			if failure == nil {
+				failure = errors.New("no pinned key matched")
+			}
+		}
+	}
+	return failure
+}
+
+// tlsVerified checks a session the way verifyTLS does, as though
+// --tls-verify were in effect, but without reporting anything
+func (config Config) tlsVerified(state tls.ConnectionState, host, name string) error {
+	config.TLSVerify = true
+	config.quiet = true
+	return config.verifyTLS(state, host, name)
+}
+
+// verifyChain checks that a certificate chain is trusted and valid
+// for name
+func (config Config) verifyChain(certs []*x509.Certificate, name string) error {
+	if len(certs) == 0 {
+		return errors.New("no certificate presented")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       name,
+		Roots:         config.rootCAs,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+func spkiDigest(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// describeVerifyError turns the errors from x509 verification into
+// something a little more useful for diagnosis
+func describeVerifyError(err error) string {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &unknownAuthority):
+		if unknownAuthority.Cert == nil {
+			return "certificate signed by an unknown authority"
+		}
+		if bytes.Equal(unknownAuthority.Cert.RawIssuer, unknownAuthority.Cert.RawSubject) {
+			return fmt.Sprintf("certificate for %s is self-signed and not trusted", unknownAuthority.Cert.Subject)
+		}
+		return fmt.Sprintf("certificate issued by unknown authority %s", unknownAuthority.Cert.Issuer)
+	case errors.As(err, &hostnameErr):
+		sans := certSANs(hostnameErr.Certificate)
+		if len(sans) == 0 {
+			return fmt.Sprintf("certificate is not valid for %s, it has no subject alternative names", hostnameErr.Host)
+		}
+		return fmt.Sprintf("certificate is not valid for %s, only for %s", hostnameErr.Host, strings.Join(sans, ", "))
+	case errors.As(err, &invalidErr):
+		cert := invalidErr.Cert
+		switch invalidErr.Reason {
+		case x509.Expired:
+			return fmt.Sprintf("certificate for %s is only valid from %s to %s", cert.Subject,
+				cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339))
+		case x509.NotAuthorizedToSign:
+			return fmt.Sprintf("%s is not a CA but was used to sign a certificate", cert.Subject)
+		case x509.IncompatibleUsage:
+			return fmt.Sprintf("certificate for %s may not be used by a server", cert.Subject)
+		}
+	}
+	return err.Error()
+}
+
+// loadRootCAs reads a PEM file, or a directory of them, to use
+// as the trust store instead of the system one
+func loadRootCAs(path string) (*x509.CertPool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if fi.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		files = files[:0]
+		for _, e := range entries {
+			if !e.IsDir() {
+				files = append(files, filepath.Join(path, e.Name()))
+			}
+		}
+	}
+	pool := x509.NewCertPool()
+	found := false
+	for _, file := range files {
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if pool.AppendCertsFromPEM(pem) {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// parsePin accepts a SHA-256 SPKI hash in base64 (as openssl and
+// curl show them, optionally with curl's sha256// prefix) or hex
+func parsePin(pin string) ([]byte, error) {
+	pin = strings.TrimPrefix(pin, "sha256//")
+	if b, err := hex.DecodeString(strings.ReplaceAll(pin, ":", "")); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(pin); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	return nil, fmt.Errorf("'%s' is not a SHA-256 hash in base64 or hex", pin)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+)
+
+// xattr is a NAME=value attribute for XCLIENT or XFORWARD
+type xattr struct {
+	name  string
+	value string
+}
+
+// parseXattrs parses the NAME=value attributes given to flag
+func parseXattrs(flag string, args []string) ([]xattr, error) {
+	var attrs []xattr
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok || name == "" {
+			return nil, Fatalf(ExitFlags, "invalid value for %s: '%s' should be NAME=value", flag, arg)
+		}
+		attrs = append(attrs, xattr{name: strings.ToUpper(name), value: value})
+	}
+	return attrs, nil
+}
+
+// xattrCommand builds an XCLIENT or XFORWARD command from the
+// attributes the server advertised support for, warning about
+// those it didn't
+func (c *Client) xattrCommand(verb string, attrs []xattr) string {
+	supported := map[string]bool{}
+	for _, name := range strings.Fields(c.ext[verb]) {
+		supported[strings.ToUpper(name)] = true
+	}
+	cmdStr := verb
+	for _, attr := range attrs {
+		if !supported[attr.name] {
+			c.Messagef(HintWarn, "Server doesn't support %s attribute %s, not sending it", verb, attr.name)
+			continue
+		}
+		cmdStr += " " + attr.name + "=" + encodeXtext(attr.value)
+	}
+	if cmdStr == verb {
+		return ""
+	}
+	return cmdStr
+}
+
+// pendingXclient reports whether we've yet to send XCLIENT, so the
+// current EHLO isn't the final one
+func (c *Client) pendingXclient() bool {
+	return len(c.config.xclient) > 0 && !c.xclient
+}
+
+// maybeXclient sends XCLIENT, if we've been asked to, and sends
+// EHLO again if the server resets the session in response
+func (c *Client) maybeXclient() error {
+	if !c.pendingXclient() {
+		return nil
+	}
+	c.xclient = true
+	if _, ok := c.ext["XCLIENT"]; !ok {
+		c.Message(HintError, "Server doesn't advertise XCLIENT")
+		return BailedError("XCLIENT not offered")
+	}
+	cmdStr := c.xattrCommand("XCLIENT", c.config.xclient)
+	if cmdStr == "" {
+		c.Message(HintError, "None of the XCLIENT attributes given are supported")
+		return BailedError("no usable XCLIENT attributes")
+	}
+	code, _, err := c.cmd(2, StageXclient, "%s", cmdStr)
+	if err != nil {
+		return err
+	}
+	if code != 220 {
+		return nil
+	}
+	// The server has started a new session, as though we'd just
+	// connected from the client we described
+	c.ext = nil
+	c.auth = nil
+	return failed(ExitHeloXclient, c.ehlo())
+}
+
+// maybeXforward sends XFORWARD, if we've been asked to. Unlike
+// XCLIENT it only affects the next transaction and doesn't reset
+// the session.
+func (c *Client) maybeXforward() error {
+	if len(c.config.xforward) == 0 {
+		return nil
+	}
+	if _, ok := c.ext["XFORWARD"]; !ok {
+		c.Message(HintError, "Server doesn't advertise XFORWARD")
+		return BailedError("XFORWARD not offered")
+	}
+	cmdStr := c.xattrCommand("XFORWARD", c.config.xforward)
+	if cmdStr == "" {
+		c.Message(HintError, "None of the XFORWARD attributes given are supported")
+		return BailedError("no usable XFORWARD attributes")
+	}
+	_, _, err := c.cmd(250, StageNone, "%s", cmdStr)
+	return err
+}